@@ -0,0 +1,302 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// DeviceConfig describes a single device to be monitored.
+type DeviceConfig struct {
+	Address  string `yaml:"address"`
+	Name     string `yaml:"name"`
+	ID       string `yaml:"id"`   // Used as the device_id label; defaults to the MAC address.
+	Room     string `yaml:"room"` // Added to every metric of the device as the room label.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Disabled bool   `yaml:"disabled"`
+
+	PollInterval time.Duration     `yaml:"poll_interval"` // Overrides POLL_INTERVAL.
+	Labels       map[string]string `yaml:"labels"`        // Added to every metric of the device.
+}
+
+// parseDeviceConfig parses a DEVICES entry of the form "address" or
+// "address|username|password". The global credentials are used unless
+// overridden.
+func parseDeviceConfig(s string) (DeviceConfig, error) {
+	parts := strings.Split(s, "|")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+
+	dc := DeviceConfig{
+		Address:  parts[0],
+		Username: cfg.Username,
+		Password: cfg.Password,
+	}
+
+	switch len(parts) {
+	case 1:
+	case 3:
+		if parts[1] == "" || parts[2] == "" {
+			return dc, fmt.Errorf("invalid device %q: username and password must not be empty", s)
+		}
+		dc.Username = parts[1]
+		dc.Password = parts[2]
+	default:
+		return dc, fmt.Errorf("invalid device %q: expected address or address|username|password", s)
+	}
+
+	if dc.Address == "" {
+		return dc, fmt.Errorf("invalid device %q: missing address", s)
+	}
+
+	return dc, nil
+}
+
+// readCredentialFiles sets the global credentials from USERNAME_FILE and
+// PASSWORD_FILE, if given, as used for Docker and Kubernetes secrets. Either
+// way, both credentials must end up set.
+func readCredentialFiles() error {
+	if cfg.UsernameFile != "" {
+		b, err := os.ReadFile(cfg.UsernameFile)
+		if err != nil {
+			return fmt.Errorf("USERNAME_FILE: %w", err)
+		}
+		cfg.Username = strings.TrimRight(string(b), "\r\n")
+	}
+	if cfg.PasswordFile != "" {
+		b, err := os.ReadFile(cfg.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("PASSWORD_FILE: %w", err)
+		}
+		cfg.Password = strings.TrimRight(string(b), "\r\n")
+	}
+
+	if cfg.Username == "" {
+		return errors.New("one of USERNAME or USERNAME_FILE is required")
+	}
+	if cfg.Password == "" {
+		return errors.New("one of PASSWORD or PASSWORD_FILE is required")
+	}
+	return nil
+}
+
+// loadDevices returns the devices to be monitored. If CONFIG_FILE is set the
+// devices are read from it, otherwise they are parsed from DEVICES.
+func loadDevices() ([]DeviceConfig, error) {
+	devices, err := loadConfiguredDevices()
+	if err != nil || !cfg.Discover {
+		return devices, err
+	}
+
+	discovered, err := discoverDevices(cfg.DiscoverTimeout)
+	if err != nil {
+		// Still monitor the explicitly configured devices.
+		level.Warn(logger).Log("msg", "Device discovery failed", "err", err)
+	}
+	configured := make(map[string]bool)
+	for _, dc := range devices {
+		configured[normalizeAddress(dc.Address)] = true
+	}
+	for _, dc := range discovered {
+		if !configured[normalizeAddress(dc.Address)] {
+			devices = append(devices, dc)
+		}
+	}
+	return devices, nil
+}
+
+func loadConfiguredDevices() ([]DeviceConfig, error) {
+	var devices []DeviceConfig
+	if cfg.ConfigFile != "" {
+		var err error
+		if devices, err = loadConfigFile(cfg.ConfigFile); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, s := range splitDevices(cfg.Devices) {
+			dc, err := parseDeviceConfig(s)
+			if err != nil {
+				return nil, err
+			}
+			devices = append(devices, dc)
+		}
+	}
+
+	if cfg.ConfigDir != "" {
+		dirDevices, err := loadConfigDir(cfg.ConfigDir)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, dirDevices...)
+	}
+	return devices, nil
+}
+
+// splitDevices splits DEVICES on commas, spaces or newlines, ignoring empty
+// entries.
+func splitDevices(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+// fileConfig is the layout of CONFIG_FILE, e.g.
+//
+//	devices:
+//	  - address: 192.168.1.10
+//	    name: Kitchen
+//	    id: kitchen-kettle
+//	    room: kitchen
+//	  - address: 192.168.1.11
+//	    username: other@example.com
+//	    password: secret
+//	  - address: 192.168.1.12
+//	    disabled: true
+//	  - address: 192.168.1.13
+//	    poll_interval: 5m
+//	    labels:
+//	      circuit: garage
+type fileConfig struct {
+	Devices []DeviceConfig `yaml:"devices"`
+}
+
+// loadConfigFile reads the device list from a YAML file. Devices without
+// credentials use the global USERNAME and PASSWORD.
+func loadConfigFile(path string) ([]DeviceConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var fc fileConfig
+	if err := yaml.UnmarshalStrict(b, &fc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for i := range fc.Devices {
+		if err := completeDeviceConfig(&fc.Devices[i]); err != nil {
+			return nil, fmt.Errorf("%s: device %d: %w", path, i+1, err)
+		}
+	}
+
+	return fc.Devices, nil
+}
+
+// loadConfigDir reads one device from each *.yaml (or *.yml) file in dir, in
+// the same format as an entry in CONFIG_FILE, e.g.
+//
+//	address: 192.168.1.10
+//	name: Kitchen
+//	room: kitchen
+//	labels:
+//	  floor: ground
+func loadConfigDir(dir string) ([]DeviceConfig, error) {
+	var paths []string
+	for _, pattern := range []string{"*.yaml", "*.yml"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, matches...)
+	}
+	sort.Strings(paths)
+
+	var devices []DeviceConfig
+	for _, path := range paths {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var dc DeviceConfig
+		if err := yaml.UnmarshalStrict(b, &dc); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if err := completeDeviceConfig(&dc); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		devices = append(devices, dc)
+	}
+	return devices, nil
+}
+
+// completeDeviceConfig tidies and checks a device read from YAML. Devices
+// without credentials use the global USERNAME and PASSWORD.
+func completeDeviceConfig(dc *DeviceConfig) error {
+	dc.Address = strings.TrimSpace(dc.Address)
+	dc.Name = strings.TrimSpace(dc.Name)
+	dc.Room = strings.TrimSpace(dc.Room)
+	if dc.Address == "" {
+		return errors.New("no address")
+	}
+	if dc.PollInterval < 0 {
+		return fmt.Errorf("device %q has a negative poll_interval", dc.Address)
+	}
+	for name := range dc.Labels {
+		if err := validateDeviceLabel(name); err != nil {
+			return fmt.Errorf("device %q: %w", dc.Address, err)
+		}
+	}
+	if dc.Username == "" {
+		dc.Username = cfg.Username
+	}
+	if dc.Password == "" {
+		dc.Password = cfg.Password
+	}
+	return nil
+}
+
+// validateLabels checks that each of LABELS names one of stdLabels.
+func validateLabels(labels []string) error {
+	return validateNames("LABELS", labels, stdLabels)
+}
+
+// reservedLabels are the label names the exporter sets itself, which a
+// device's labels must not use.
+var reservedLabels = append([]string{"reason", "outlet", "le"}, stdLabels...)
+
+// validateDeviceLabel checks that name may be used in a device's labels.
+func validateDeviceLabel(name string) error {
+	if !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") {
+		return fmt.Errorf("invalid label name %q", name)
+	}
+	for _, reserved := range reservedLabels {
+		if name == reserved {
+			return fmt.Errorf("label %q is reserved for the exporter", name)
+		}
+	}
+	return nil
+}
+
+// energyMetrics are the power-block metrics that may be selected with
+// ENERGY_METRICS.
+var energyMetrics = []string{"power", "today_runtime", "today_energy", "month_runtime", "month_energy"}
+
+// validateEnergyMetrics checks that each of ENERGY_METRICS names one of
+// energyMetrics.
+func validateEnergyMetrics(metrics []string) error {
+	return validateNames("ENERGY_METRICS", metrics, energyMetrics)
+}
+
+func validateNames(option string, names []string, valid []string) error {
+	for _, name := range names {
+		known := false
+		for _, v := range valid {
+			known = known || name == v
+		}
+		if !known {
+			return fmt.Errorf("invalid name %q in %s: expected one of %s", name, option, strings.Join(valid, ", "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"hash/crc32"
+	"net"
+	"time"
+
+	"github.com/go-kit/log/level"
+)
+
+// Tapo devices do not advertise themselves over mDNS or SSDP; instead they
+// answer a broadcast "discovery" packet on UDP port 20002. The request is a
+// 16 byte header followed by a JSON body carrying an RSA public key.
+const (
+	discoveryPort       = 20002
+	discoveryHeaderSize = 16
+	discoveryInitialCRC = 0x5A6B7C8D
+)
+
+// discoveryResponse holds the fields of a discovery reply that we use.
+type discoveryResponse struct {
+	ErrorCode int `json:"error_code"`
+	Result    struct {
+		DeviceID    string `json:"device_id"`
+		DeviceType  string `json:"device_type"`
+		DeviceModel string `json:"device_model"`
+		IP          string `json:"ip"`
+		Mac         string `json:"mac"`
+	} `json:"result"`
+}
+
+// discoveryRequest builds the broadcast packet: version 2, message type 0, op
+// code 1, then the body length, flags and a random serial. The CRC of the
+// whole packet, computed with a fixed seed in its place, goes in bytes 12-16.
+func discoveryRequest() ([]byte, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"params": map[string]string{
+			"rsa_key": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var serial [4]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, err
+	}
+	packet := make([]byte, discoveryHeaderSize, discoveryHeaderSize+len(body))
+	packet[0] = 2
+	packet[1] = 0
+	binary.BigEndian.PutUint16(packet[2:], 1)
+	binary.BigEndian.PutUint16(packet[4:], uint16(len(body)))
+	packet[6] = 17
+	packet[7] = 0
+	copy(packet[8:12], serial[:])
+	binary.BigEndian.PutUint32(packet[12:], discoveryInitialCRC)
+	packet = append(packet, body...)
+	binary.BigEndian.PutUint32(packet[12:], crc32.ChecksumIEEE(packet))
+	return packet, nil
+}
+
+// discoverDevices broadcasts a discovery request and returns a DeviceConfig,
+// using the global credentials, for each device that answers within timeout.
+func discoverDevices(timeout time.Duration) ([]DeviceConfig, error) {
+	packet, err := discoveryRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.WriteToUDP(packet, &net.UDPAddr{IP: net.IPv4bcast, Port: discoveryPort}); err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	var devices []DeviceConfig
+	seen := make(map[string]bool)
+	buf := make([]byte, 4096)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			return devices, err
+		}
+		if n <= discoveryHeaderSize {
+			continue
+		}
+
+		var resp discoveryResponse
+		if err := json.Unmarshal(buf[discoveryHeaderSize:n], &resp); err != nil || resp.ErrorCode != 0 {
+			level.Debug(logger).Log("msg", "Ignoring discovery reply", "from", from, "err", err, "error_code", resp.ErrorCode)
+			continue
+		}
+		address := resp.Result.IP
+		if address == "" {
+			address = from.IP.String()
+		}
+		if seen[address] {
+			continue
+		}
+		seen[address] = true
+
+		level.Info(logger).Log("msg", "Discovered device", "device", address, "model", resp.Result.DeviceModel, "mac", resp.Result.Mac)
+		devices = append(devices, DeviceConfig{
+			Address:  address,
+			Username: cfg.Username,
+			Password: cfg.Password,
+		})
+	}
+	return devices, nil
+}
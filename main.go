@@ -1,10 +1,30 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
 
 	"github.com/go-kit/log/level"
 
@@ -20,22 +40,103 @@ import (
 	"github.com/paulcager/tapo-lib"
 )
 
-const (
-	namespace = "tapo"
-	subsystem = "device"
-)
-
 var (
 	cfg    Config
 	logger log.Logger
 )
 
+// requestDuration is shared by all devices, and labelled only by model and type
+// to bound the number of series. It is created by NewExporter.
+var requestDuration *prometheus.HistogramVec
+
+// capabilities describes what a model reports beyond the basic device info.
+type capabilities struct {
+	power bool // Supports GetEnergyUsage.
+	light bool // A bulb that reports brightness and colour.
+	strip bool // A power strip, whose outlets are reported as child devices.
+}
+
+// modelCapabilities maps (upper-case) model names to their capabilities.
+// Models not listed are treated as plain plugs.
+var modelCapabilities = map[string]capabilities{
+	"P110":  {power: true},
+	"P110M": {power: true},
+	"P115":  {power: true},
+	"KP115": {power: true},
+	"KP125": {power: true},
+	"P300":  {strip: true},
+	"L510":  {light: true},
+	"L520":  {light: true},
+	"L530":  {light: true},
+	"L535":  {light: true},
+}
+
 type Config struct {
-	ServerPort             string   `required:"true" split_words:"true" default:":9782"`
-	Username               string   `split_words:"true" required:"true"`
-	Password               string   `split_words:"true" required:"true"`
-	DisableExporterMetrics bool     `split_words:"true" required:"true" default:"true"`
-	Devices                []string `split_words:"true" required:"true"`
+	ServerPort                string        `required:"true" split_words:"true" default:":9782"`
+	Username                  string        `split_words:"true"`
+	UsernameFile              string        `split_words:"true"`
+	Password                  string        `split_words:"true"`
+	PasswordFile              string        `split_words:"true"`
+	DisableExporterMetrics    bool          `split_words:"true" required:"true" default:"true"`
+	Devices                   string        `split_words:"true"`
+	ConfigFile                string        `split_words:"true"`
+	RequestTimeout            time.Duration `split_words:"true" default:"10s"`
+	CacheTTL                  time.Duration `split_words:"true" default:"0s"`
+	PollInterval              time.Duration `split_words:"true" default:"15s"`
+	ReconnectAfterFailures    int           `split_words:"true" default:"3"`
+	MaxConcurrentScrapes      int           `split_words:"true"`             // Defaults to the number of devices.
+	MaxRetries                int           `split_words:"true" default:"1"` // Attempts per refresh, including the first.
+	EnableControl             bool          `split_words:"true" default:"false"`
+	MetricsPath               string        `split_words:"true" default:"/metrics"`
+	Labels                    []string      `split_words:"true" default:"model,ip,mac,type,name"`
+	OnTimeCounter             bool          `split_words:"true" default:"false"`
+	TLSCertFile               string        `split_words:"true"`
+	TLSKeyFile                string        `split_words:"true"`
+	MetricsUsername           string        `split_words:"true"`
+	MetricsPassword           string        `split_words:"true"`
+	RefreshDeadline           time.Duration `split_words:"true" default:"0s"` // Zero means no overall deadline.
+	DebugEndpoints            bool          `split_words:"true" default:"false"`
+	MetricNamespace           string        `split_words:"true" default:"tapo"`
+	MetricSubsystem           string        `split_words:"true" default:"device"`
+	EnergyInterval            time.Duration `split_words:"true" default:"0s"` // Minimum time between energy requests.
+	ValidateOnly              bool          `split_words:"true" default:"false"`
+	LogLevel                  string        `split_words:"true" default:"info"`   // debug, info, warn or error.
+	LogFormat                 string        `split_words:"true" default:"logfmt"` // logfmt or json.
+	DisabledDevices           []string      `split_words:"true"`
+	VerifyCredentialsOnStart  bool          `split_words:"true" default:"false"`
+	PollJitter                float64       `split_words:"true" default:"0.1"`       // Fraction of POLL_INTERVAL.
+	TypeLabel                 string        `split_words:"true" default:"avatar"`    // avatar (falling back to model) or model.
+	EnergyKWh                 bool          `envconfig:"ENERGY_KWH" default:"false"` // Also export energy in kWh.
+	DeviceProxyURL            string        `split_words:"true"`                     // http://, https:// or socks5:// proxy for device requests.
+	EnergyMetrics             []string      `split_words:"true" default:"power,today_runtime,today_energy,month_runtime,month_energy"`
+	CollectTimeout            time.Duration `split_words:"true" default:"0s"`    // Zero means wait for every device.
+	Discover                  bool          `split_words:"true" default:"false"` // Also find devices by UDP broadcast at startup.
+	DiscoverTimeout           time.Duration `split_words:"true" default:"3s"`
+	EnableReset               bool          `split_words:"true" default:"false"` // Serve POST /reset to zero a device's errors counter.
+	DevicePollIntervals       []string      `split_words:"true"`                 // address=interval pairs overriding POLL_INTERVAL.
+	PowerHistogram            bool          `split_words:"true" default:"false"` // Also export a histogram of power readings.
+	ErrorOnAllDown            bool          `split_words:"true" default:"false"` // Fail scrapes with HTTP 500 if no device is up.
+	ConfigDir                 string        `split_words:"true"`                 // Directory of *.yaml files, one device each.
+	BackoffAfterFailures      int           `split_words:"true" default:"0"`     // Zero disables backoff.
+	BackoffIntervals          int           `split_words:"true" default:"10"`    // While backing off, poll every this many intervals.
+	InitialRefreshTimeout     time.Duration `split_words:"true" default:"10s"`   // Zero skips the refresh before listening.
+	MetricTimestamps          bool          `split_words:"true" default:"false"` // Timestamp device state with the last successful refresh.
+	DeviceMaxIdleConns        int           `split_words:"true" default:"0"`     // Across all devices; zero means no limit.
+	DeviceMaxIdleConnsPerHost int           `split_words:"true" default:"1"`     // Requests to a device are made one at a time.
+	DeviceIdleConnTimeout     time.Duration `split_words:"true" default:"90s"`
+	DeviceKeepAlives          bool          `split_words:"true" default:"true"`
+	CollectWorkers            int           `split_words:"true"`                 // Defaults to the number of CPUs.
+	EnableRefresh             bool          `split_words:"true" default:"false"` // Serve POST /refresh to refresh a device on demand.
+	ClockDrift                bool          `split_words:"true" default:"false"` // Also request the device time, to export clock drift.
+	ServerReadTimeout         time.Duration `split_words:"true" default:"10s"`
+	ServerWriteTimeout        time.Duration `split_words:"true" default:"60s"` // Must allow for POST /refresh and /control.
+	ServerIdleTimeout         time.Duration `split_words:"true" default:"120s"`
+	InfoLocationLabels        bool          `split_words:"true" default:"false"` // Add region and timezone labels to tapo_device_info.
+	PowerPrecision            float64       `split_words:"true" default:"0"`     // Round power to a multiple of this many watts; zero disables.
+	ReadOnly                  bool          `split_words:"true" default:"false"` // Refuse any request that could change a device.
+	LoadThresholdWatts        float64       `split_words:"true" default:"1"`     // Power above which tapo_device_load_detected is 1.
+	Countdown                 bool          `split_words:"true" default:"false"` // Also request the countdown rules, to export the time remaining.
+	ShutdownTimeout           time.Duration `split_words:"true" default:"15s"`   // Longest to wait for refreshes in progress on SIGTERM.
 }
 
 func main() {
@@ -43,8 +144,61 @@ func main() {
 	if err != nil {
 		stdLog.Panic(err)
 	}
+	if err := readCredentialFiles(); err != nil {
+		stdLog.Panic(err)
+	}
+	if cfg.RequestTimeout <= 0 {
+		stdLog.Panicf("REQUEST_TIMEOUT must be greater than zero, got %s", cfg.RequestTimeout)
+	}
+	if cfg.PollInterval <= 0 {
+		stdLog.Panicf("POLL_INTERVAL must be greater than zero, got %s", cfg.PollInterval)
+	}
+	if cfg.PollJitter < 0 || cfg.PollJitter > 1 {
+		stdLog.Panicf("POLL_JITTER must be between 0 and 1, got %v", cfg.PollJitter)
+	}
+	if cfg.ReadOnly && cfg.EnableControl {
+		stdLog.Panic("ENABLE_CONTROL cannot be used with READ_ONLY")
+	}
+	if cfg.PowerPrecision < 0 {
+		stdLog.Panicf("POWER_PRECISION must not be negative, got %v", cfg.PowerPrecision)
+	}
+	if !strings.HasPrefix(cfg.MetricsPath, "/") {
+		stdLog.Panicf("METRICS_PATH must start with /, got %q", cfg.MetricsPath)
+	}
+	for _, path := range reservedPaths {
+		if cfg.MetricsPath == path {
+			stdLog.Panicf("METRICS_PATH cannot be %q, which the exporter already serves", cfg.MetricsPath)
+		}
+	}
+	if err := validateLabels(cfg.Labels); err != nil {
+		stdLog.Panic(err)
+	}
+	if err := validateEnergyMetrics(cfg.EnergyMetrics); err != nil {
+		stdLog.Panic(err)
+	}
+	if cfg.TypeLabel != "avatar" && cfg.TypeLabel != "model" {
+		stdLog.Panicf("TYPE_LABEL must be avatar or model, got %q", cfg.TypeLabel)
+	}
+	if err := configureTransport(); err != nil {
+		stdLog.Panic(err)
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		stdLog.Panic("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if (cfg.MetricsUsername == "") != (cfg.MetricsPassword == "") {
+		stdLog.Panic("METRICS_USERNAME and METRICS_PASSWORD must be set together")
+	}
 
-	promLogConfig := &promlog.Config{}
+	promLogConfig := &promlog.Config{
+		Level:  &promlog.AllowedLevel{},
+		Format: &promlog.AllowedFormat{},
+	}
+	if err := promLogConfig.Level.Set(cfg.LogLevel); err != nil {
+		stdLog.Panic(err)
+	}
+	if err := promLogConfig.Format.Set(cfg.LogFormat); err != nil {
+		stdLog.Panic(err)
+	}
 	logger = promlog.New(promLogConfig)
 
 	level.Info(logger).Log("msg", "Starting tapo_exporter", "version", version.Info())
@@ -63,240 +217,2284 @@ func main() {
 		panic(err)
 	}
 
+	if cfg.VerifyCredentialsOnStart {
+		if err := exporter.verifyCredentials(); err != nil {
+			level.Error(logger).Log("msg", "Credential check failed", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	if cfg.ValidateOnly {
+		if !exporter.validate(os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
+	// verifyCredentials has already refreshed every device.
+	if !cfg.VerifyCredentialsOnStart && cfg.InitialRefreshTimeout > 0 {
+		exporter.initialRefresh(cfg.InitialRefreshTimeout)
+	}
+	exporter.start()
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		level.Info(logger).Log("msg", "Shutting down")
+		exporter.stop(cfg.ShutdownTimeout)
+		os.Exit(0)
+	}()
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			level.Info(logger).Log("msg", "Reloading devices")
+			exporter.reload()
+		}
+	}()
+
 	registry.MustRegister(exporter)
 	registry.MustRegister(version.NewCollector("tapo_exporter"))
 
-	http.Handle("/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`
-<html>
-			<head><title>Tapo Exporter</title></head>
-			<body>
-			<h1>Tapo Exporter</h1>
-			<p><a href="/metrics">Metrics</a></p>
-			</body>
-</html>
-`))
-	})
+	// METRICS_USERNAME protects the metrics, the optional endpoints and the
+	// index page, which lists the devices; only /healthz is left open.
+	protect := func(h http.Handler) http.Handler {
+		if cfg.MetricsUsername == "" {
+			return h
+		}
+		return basicAuth(h, cfg.MetricsUsername, cfg.MetricsPassword)
+	}
+	http.Handle(cfg.MetricsPath, protect(promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})))
+	http.HandleFunc("/healthz", exporter.healthz)
+	if cfg.EnableControl {
+		http.Handle("/control", protect(http.HandlerFunc(exporter.control)))
+	}
+	if cfg.EnableReset {
+		http.Handle("/reset", protect(http.HandlerFunc(exporter.reset)))
+	}
+	if cfg.EnableRefresh {
+		http.Handle("/refresh", protect(http.HandlerFunc(exporter.refreshHandler)))
+	}
+	if cfg.DebugEndpoints {
+		http.Handle("/debug/devices", protect(http.HandlerFunc(exporter.debugDevices)))
+	}
+	http.Handle("/", protect(http.HandlerFunc(exporter.index)))
 
-	stdLog.Fatal(http.ListenAndServe(cfg.ServerPort, nil))
+	server := &http.Server{
+		Addr:              cfg.ServerPort,
+		ReadTimeout:       cfg.ServerReadTimeout,
+		ReadHeaderTimeout: cfg.ServerReadTimeout,
+		WriteTimeout:      cfg.ServerWriteTimeout,
+		IdleTimeout:       cfg.ServerIdleTimeout,
+	}
+	if cfg.TLSCertFile != "" {
+		stdLog.Fatal(server.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile))
+	}
+	stdLog.Fatal(server.ListenAndServe())
 }
 
+// reservedPaths are the paths served other than METRICS_PATH, which must not
+// clash with them.
+var reservedPaths = []string{"/", "/healthz", "/control", "/reset", "/refresh", "/debug/devices"}
+
 type Device struct {
 	sync.Mutex
-	address       string
-	session       *tapo.Session
+	// sessionMutex serializes use of the session, so that refreshes of a
+	// device do not overlap, without holding the lock during requests. It
+	// guards session, resolved, reqCtx, model and devType.
+	sessionMutex  sync.Mutex
+	address       string        // As configured; may be a hostname.
+	name          string        // Overrides the Tapo nickname, if set.
+	disabled      bool          // Never refreshed, so always reported as down.
+	pollInterval  time.Duration // Changed, like disabled, only by reload with the lock held.
+	resolved      string        // Address the current session connects to.
+	config        DeviceConfig
+	session       deviceSession
+	sessionStart  time.Time       // When session was (re)created.
+	reqCtx        context.Context // Context of the refresh in progress, if any.
 	initialised   bool
 	supportsPower bool
+	supportsLight bool
+	supportsStrip bool
+	model         string // Last reported model and type, for requestDuration.
+	devType       string
 
 	lastWasValid bool
+	lastErr      error     // Error from the last refresh, if any.
+	lastRefresh  time.Time // Time of last successful refresh.
+	lastInfo     *tapo.DeviceInfo
+	lastEnergy   *tapo.EnergyUsage
+
+	lastEnergyFetch time.Time
 
-	up         prometheus.Gauge
-	errors     prometheus.Counter
-	on         prometheus.Gauge
-	onTime     prometheus.Gauge
-	overheated prometheus.Gauge
+	consecutiveFailures int
+	skippedPolls        int // Polls skipped since the last attempt while backing off.
+
+	baseLabels      prometheus.Labels // Const labels of up and the other base metrics.
+	upDesc          atomic.Value      // up's *prometheus.Desc, readable without the lock.
+	up              prometheus.Gauge
+	errors          prometheus.Counter
+	reconnects      prometheus.Counter
+	duration        prometheus.Gauge
+	lastSeen        prometheus.Gauge
+	failures        prometheus.Gauge
+	sessionAge      prometheus.Gauge
+	lastError       *prometheus.GaugeVec
+	lastErrorReason string // Label of lastError's only child, if the last refresh failed.
+	neverConnected  prometheus.Gauge
+	backoff         prometheus.Gauge
+	on              prometheus.Gauge
+	onTime          prometheus.Gauge
+	overheated      prometheus.Gauge
+	rssi            prometheus.Gauge
+	signalLevel     prometheus.Gauge
+	info            prometheus.Gauge
+	canPower        prometheus.Gauge
+	defaultState    prometheus.Gauge // Created once the default state is known.
+	countdown       prometheus.Gauge // Only if Countdown is set and the device reports its countdown rules.
+	wifiInfo        prometheus.Gauge // Recreated if the device moves to another network.
+	clockDrift      prometheus.Gauge // Only if ClockDrift is set and the device reports its time.
+	ssid            string           // SSID that wifiInfo reflects.
+	noCountdown     bool             // Set if the device rejects get_countdown_rules.
+
+	// Derived from onTime, if OnTimeCounter is set.
+	onTimeTotal prometheus.Counter
+	prevOnTime  float64
 
 	// Power-management only
 	currentPower   prometheus.Gauge
 	todayRuntime   prometheus.Gauge
 	todayWattHours prometheus.Gauge
+	monthRuntime   prometheus.Gauge
+	monthWattHours prometheus.Gauge
+	protection     prometheus.Gauge
+	energyErrors   prometheus.Counter
+	energyValid    prometheus.Gauge
+	loadDetected   prometheus.Gauge
+	powerHist      prometheus.Histogram // Only if PowerHistogram is set.
+	todayKWh       prometheus.Gauge     // Only if EnergyKWh is set.
+	monthKWh       prometheus.Gauge
+
+	// Light bulbs only
+	brightness prometheus.Gauge
+	colorTemp  prometheus.Gauge
+	hue        prometheus.Gauge
+	saturation prometheus.Gauge
+
+	// Power strips only
+	outletOn *prometheus.GaugeVec
+	outlets  map[int]prometheus.Gauge // outletOn's children, by position.
 }
 
-func NewDevice(address string) (*Device, error) {
-	dev := &Device{address: address}
+func NewDevice(dc DeviceConfig) (*Device, error) {
+	address := dc.Address
+	dev := &Device{address: address, name: dc.Name, disabled: dc.Disabled, config: dc}
+	dev.pollInterval = dc.PollInterval
+	if dev.pollInterval <= 0 {
+		dev.pollInterval = cfg.PollInterval
+	}
 
-	sess, err := tapo.NewSession(address, cfg.Username, cfg.Password)
-	if err != nil {
+	if err := dev.newSession(); err != nil {
 		return nil, err
 	}
-	sess.Client = &http.Client{Timeout: time.Second * 10}
 
-	dev.session = sess
-	dev.up = prometheus.NewGauge(prometheus.GaugeOpts{
-		Namespace:   namespace,
-		Subsystem:   subsystem,
+	dev.newBaseMetrics(deviceBaseLabels(dc))
+	dev.neverConnected.Set(1)
+
+	return dev, nil
+}
+
+// newBaseMetrics (re)creates the metrics that exist before the device has
+// first responded, with the given const labels.
+func (d *Device) newBaseMetrics(baseLabels prometheus.Labels) {
+	d.baseLabels = baseLabels
+	d.up = newUpGauge(baseLabels)
+	d.upDesc.Store(d.up.Desc())
+	d.errors = newErrorsCounter(baseLabels)
+	d.reconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   cfg.MetricNamespace,
+		Subsystem:   cfg.MetricSubsystem,
+		Name:        "reconnects",
+		Help:        "Count of sessions recreated after repeated errors",
+		ConstLabels: baseLabels,
+	})
+	d.duration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   cfg.MetricNamespace,
+		Subsystem:   cfg.MetricSubsystem,
+		Name:        "scrape_duration_seconds",
+		Help:        "Time taken to retrieve device info",
+		ConstLabels: baseLabels,
+	})
+	d.lastSeen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   cfg.MetricNamespace,
+		Subsystem:   cfg.MetricSubsystem,
+		Name:        "last_success_timestamp_seconds",
+		Help:        "Unix time of the last successful device info retrieval",
+		ConstLabels: baseLabels,
+	})
+	d.failures = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   cfg.MetricNamespace,
+		Subsystem:   cfg.MetricSubsystem,
+		Name:        "consecutive_failures",
+		Help:        "Number of refreshes that have failed since the last success",
+		ConstLabels: baseLabels,
+	})
+	d.sessionAge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   cfg.MetricNamespace,
+		Subsystem:   cfg.MetricSubsystem,
+		Name:        "session_age_seconds",
+		Help:        "Time since the session with the device was created",
+		ConstLabels: baseLabels,
+	})
+	d.lastError = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   cfg.MetricNamespace,
+		Subsystem:   cfg.MetricSubsystem,
+		Name:        "last_error",
+		Help:        "Set to 1, with the likely reason, if the last refresh failed",
+		ConstLabels: baseLabels,
+	}, []string{"reason"})
+	d.neverConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   cfg.MetricNamespace,
+		Subsystem:   cfg.MetricSubsystem,
+		Name:        "never_connected",
+		Help:        "Set to 1 until the device first responds",
+		ConstLabels: baseLabels,
+	})
+	d.backoff = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   cfg.MetricNamespace,
+		Subsystem:   cfg.MetricSubsystem,
+		Name:        "backoff_active",
+		Help:        "Is the device being polled less often after repeated failures",
+		ConstLabels: baseLabels,
+	})
+}
+
+func newUpGauge(labels prometheus.Labels) prometheus.Gauge {
+	return prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   cfg.MetricNamespace,
+		Subsystem:   cfg.MetricSubsystem,
 		Name:        "up",
 		Help:        "Is the device up",
-		ConstLabels: map[string]string{"ip": address},
+		ConstLabels: labels,
 	})
-	dev.errors = prometheus.NewCounter(prometheus.CounterOpts{
-		Namespace:   namespace,
-		Subsystem:   subsystem,
+}
+
+// newErrorsCounter creates a device's errors counter. Apart from by
+// newBaseMetrics, it is only called by the /reset endpoint.
+func newErrorsCounter(labels prometheus.Labels) prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   cfg.MetricNamespace,
+		Subsystem:   cfg.MetricSubsystem,
 		Name:        "errors",
 		Help:        "Count of errors retrieving details",
-		ConstLabels: map[string]string{"ip": address},
+		ConstLabels: labels,
 	})
+}
 
-	return dev, nil
+// deviceBaseLabels returns the const labels for the metrics that exist before
+// the device has first responded: its configured address, its device_id if
+// configured and LABELS includes it, and its room and labels if configured.
+func deviceBaseLabels(dc DeviceConfig) prometheus.Labels {
+	labels := prometheus.Labels{"ip": dc.Address}
+	if dc.ID != "" && labelEnabled("device_id") {
+		labels["device_id"] = sanitizeLabelValue(dc.ID)
+	}
+	if dc.Room != "" {
+		labels["room"] = sanitizeLabelValue(dc.Room)
+	}
+	for name, value := range dc.Labels {
+		labels[name] = sanitizeLabelValue(value)
+	}
+	return labels
 }
 
-func (d *Device) refresh() {
-	d.Lock()
-	defer d.Unlock()
+func labelEnabled(name string) bool {
+	for _, l := range cfg.Labels {
+		if l == name {
+			return true
+		}
+	}
+	return false
+}
 
-	start := time.Now()
+// deviceSession is the subset of *tapo.Session used by Device, so that a fake
+// can stand in for real hardware.
+type deviceSession interface {
+	GetDeviceInfo() (*tapo.DeviceInfo, error)
+	GetEnergyUsage() (*tapo.EnergyUsage, error)
+	Switch(on bool) error
+	Post(body interface{}, response interface{}) error
+}
 
-	info, err := d.session.GetDeviceInfo()
+// openSession creates the session used to talk to a device. It may be replaced
+// to substitute a fake deviceSession.
+var openSession = func(address, username, password string, client *http.Client) (deviceSession, error) {
+	sess, err := tapo.NewSession(address, username, password)
 	if err != nil {
-		level.Warn(logger).Log("device", d.address, "err", err, "time", time.Since(start).Seconds())
-	} else {
-		level.Debug(logger).Log("device", d.address, "on", info.DeviceOn, "time", time.Since(start).Seconds())
+		return nil, err
+	}
+	sess.Client = client
+	if cfg.ReadOnly {
+		return readOnlySession{sess}, nil
+	}
+	return sess, nil
+}
+
+// readOnlySession refuses Switch, and any Post other than a "get_" method, so
+// that READ_ONLY guarantees the exporter never changes a device.
+type readOnlySession struct {
+	deviceSession
+}
+
+var errReadOnly = errors.New("refused: READ_ONLY is set")
+
+func (s readOnlySession) Switch(on bool) error {
+	return errReadOnly
+}
+
+func (s readOnlySession) Post(body interface{}, response interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	var req struct {
+		Method string `json:"method"`
+	}
+	if err := json.Unmarshal(b, &req); err != nil || !strings.HasPrefix(req.Method, "get_") {
+		return fmt.Errorf("%s: %w", req.Method, errReadOnly)
+	}
+	return s.deviceSession.Post(body, response)
+}
+
+// newSession replaces the device's session with a new one, forcing a fresh
+// handshake on the next request. Hostnames are re-resolved so that a device
+// whose DHCP address has changed is found again. d.sessionMutex must be held.
+func (d *Device) newSession() error {
+	host, port := splitPort(d.address)
+	resolved := resolve(host)
+	changed := d.resolved != "" && resolved != d.resolved
+	if changed {
+		level.Info(logger).Log("msg", "Device address changed", "device", d.address, "old", d.resolved, "new", resolved)
+	}
+	d.resolved = resolved
+
+	client := &http.Client{
+		Timeout:   cfg.RequestTimeout,
+		Transport: contextTransport{dev: d, base: deviceTransport},
+	}
+	target := urlHost(resolved)
+	if port != "" {
+		target = net.JoinHostPort(resolved, port)
+	}
+	sess, err := openSession(target, d.config.Username, d.config.Password, client)
+	if err != nil {
+		return err
+	}
+
+	d.session = sess
+	d.Lock()
+	if changed {
+		// Recreate the labelled gauges so that "ip" reflects the new address.
+		d.initialised = false
+	}
+	d.sessionStart = time.Now()
+	d.Unlock()
+	return nil
+}
+
+// deviceTransport is used for all requests to devices.
+var deviceTransport http.RoundTripper = http.DefaultTransport
+
+// configureTransport sets up the transport shared by all device requests,
+// with the connection pooling options and, if set, DEVICE_PROXY_URL. Unlike
+// net/http, the defaults keep one idle connection per device however many
+// there are, rather than redialling once there are more than 100. tapo-lib
+// makes its handshake request with http.DefaultClient, so that uses it too,
+// with the same timeout as the device's own client.
+func configureTransport() error {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = cfg.DeviceMaxIdleConns
+	transport.MaxIdleConnsPerHost = cfg.DeviceMaxIdleConnsPerHost
+	transport.IdleConnTimeout = cfg.DeviceIdleConnTimeout
+	transport.DisableKeepAlives = !cfg.DeviceKeepAlives
+	transport.ResponseHeaderTimeout = cfg.RequestTimeout
+
+	if cfg.DeviceProxyURL != "" {
+		u, err := url.Parse(cfg.DeviceProxyURL)
+		if err != nil {
+			return fmt.Errorf("DEVICE_PROXY_URL: %w", err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("DEVICE_PROXY_URL: unsupported scheme %q", u.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+
+	deviceTransport = transport
+	http.DefaultClient.Transport = transport
+	http.DefaultClient.Timeout = cfg.RequestTimeout
+	return nil
+}
+
+// contextTransport applies the context of the device's refresh in progress to
+// each request, as tapo-lib has no context-aware methods. It relies on requests
+// only being made with the device's sessionMutex held. Note that tapo-lib
+// makes its handshake request with http.DefaultClient, which cannot be
+// cancelled but is bounded by REQUEST_TIMEOUT.
+type contextTransport struct {
+	dev  *Device
+	base http.RoundTripper
+}
+
+func (t contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if ctx := t.dev.reqCtx; ctx != nil {
+		req = req.WithContext(ctx)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// refresh retrieves the latest state of the device. Cancelling ctx aborts any
+// request in progress and skips the remaining ones. The requests are made
+// without the device lock, which is only taken to update its state, so that a
+// slow device does not hold up Collect.
+func (d *Device) refresh(ctx context.Context) {
+	d.sessionMutex.Lock()
+	defer d.sessionMutex.Unlock()
+
+	skip, needRaw := d.refreshNeeds()
+	if skip {
+		return
 	}
 
-	d.lastWasValid = err == nil
+	start := time.Now()
+
+	// The HTTP timeout bounds each request; the deadline bounds all of them.
+	if cfg.RefreshDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, start.Add(cfg.RefreshDeadline))
+		defer cancel()
+	}
+	ctx = withRequestID(ctx)
+	rlog := requestLogger(ctx)
+	d.reqCtx = ctx
+	defer func() { d.reqCtx = nil }()
 
+	info, err := d.getDeviceInfo(ctx)
+	elapsed := time.Since(start)
 	if err != nil {
-		d.up.Set(0)
-		d.errors.Inc()
+		level.Warn(rlog).Log("device", d.address, "err", err, "time", elapsed.Seconds())
+		if d.recordFailure(err, elapsed) {
+			d.reconnect()
+		}
 		return
 	}
-	d.up.Set(1)
+	level.Debug(rlog).Log("device", d.address, "on", info.DeviceOn, "time", elapsed.Seconds())
 
-	if !d.initialised {
-		d.initialised = true
+	// A single raw get_device_info covers everything tapo.DeviceInfo does not
+	// decode, and is only made if one of those fields is needed.
+	var raw *rawDeviceInfo
+	if needRaw || info.DefaultStates.Type == "custom" {
+		var rawErr error
+		if raw, rawErr = getRawDeviceInfo(d.session); rawErr != nil {
+			level.Warn(rlog).Log("device", d.address, "op", "raw_device_info", "err", rawErr)
+		}
+	}
 
-		d.on = stdGauge("on", "Is the plug on", info)
-		d.onTime = stdGauge("onTime", "Cumulative on time", info) // Cannot be a counter because Tapo may reset.
-		d.overheated = stdGauge("overheated", "Is the plug overheated", info)
+	want := d.recordInfo(start, elapsed, info, raw, rlog)
 
-		d.supportsPower = strings.EqualFold("P115", info.Model)
-		if d.supportsPower {
-			d.currentPower = stdGauge("power", "power (watts)", info)
-			d.todayRuntime = stdGauge("today_runtime", "Runtime today (mins)", info)
-			d.todayWattHours = stdGauge("today_energy", "Energy today (watt-hours)", info)
+	if ctx.Err() != nil {
+		level.Warn(rlog).Log("device", d.address, "msg", "Refresh cancelled or deadline exceeded after device info", "err", ctx.Err(), "time", time.Since(start).Seconds())
+		d.countError()
+		return
+	}
+
+	if cfg.ClockDrift {
+		// Halve the round trip to estimate when the device read its clock.
+		sent := time.Now()
+		deviceTime, err := getDeviceTime(d.session)
+		if err == nil {
+			host := sent.Add(time.Since(sent) / 2)
+			d.recordClockDrift(deviceTime.Sub(host), info)
+		} else {
+			level.Debug(rlog).Log("device", d.address, "op", "device_time", "err", err)
 		}
 	}
 
-	d.on.Set(b2f(info.DeviceOn))
-	d.onTime.Set(info.OnTime)
-	d.overheated.Set(b2f(info.Overheated))
+	if want.countdown {
+		remaining, supported, err := getCountdown(d.session)
+		d.recordCountdown(remaining, supported, err, info, rlog)
+	}
 
-	if d.supportsPower {
+	if want.energy {
 		energy, err := d.session.GetEnergyUsage()
+		d.recordEnergy(energy, err, rlog)
+	}
+
+	if want.children {
+		children, err := getChildDevices(d.session)
 		if err == nil {
-			d.todayRuntime.Set(float64(energy.TodayRuntimeMins))
-			d.todayWattHours.Set(float64(energy.TodayEnergyWattHours))
-			d.currentPower.Set(float64(energy.CurrentPowerMilliWatts) / 1000.0)
+			d.recordChildren(children)
+		} else {
+			level.Warn(rlog).Log("device", d.address, "op", "child_devices", "err", err)
 		}
 	}
 }
 
-func (d *Device) Describe(ch chan<- *prometheus.Desc) {
-	describe(d.up, ch)
-	describe(d.errors, ch)
-	describe(d.on, ch)
-	describe(d.onTime, ch)
-	describe(d.overheated, ch)
-	describe(d.currentPower, ch)
-	describe(d.todayRuntime, ch)
-	describe(d.todayWattHours, ch)
+// The record methods below apply the results of a refresh's requests. Each
+// takes the device lock itself, and releases it even if it panics, so that a
+// panic recovered by refreshDevice does not leave the device locked.
+
+// refreshNeeds reports whether the refresh should be skipped, as the device is
+// disabled or its last refresh is recent enough to be reused, and whether the
+// raw device info will be needed.
+func (d *Device) refreshNeeds() (skip, needRaw bool) {
+	d.Lock()
+	defer d.Unlock()
+	cached := cfg.CacheTTL > 0 && d.lastWasValid && time.Since(d.lastRefresh) < cfg.CacheTTL
+	return d.disabled || cached, !d.initialised || d.supportsLight
+}
+
+// recordFailure records a failed device info request, and reports whether the
+// session is due to be recreated.
+func (d *Device) recordFailure(err error, elapsed time.Duration) (reconnect bool) {
+	d.Lock()
+	defer d.Unlock()
+	d.duration.Set(elapsed.Seconds())
+	return d.setFailed(err)
 }
 
-func describe(m prometheus.Metric, ch chan<- *prometheus.Desc) {
-	if m != nil {
-		ch <- m.Desc()
-	}
+// refreshPlan lists the requests that follow a successful device info request.
+type refreshPlan struct {
+	countdown, energy, children bool
 }
 
-func (d *Device) Collect(ch chan<- prometheus.Metric) {
+// recordInfo records a successful device info request, and returns the
+// requests that should follow it.
+func (d *Device) recordInfo(start time.Time, elapsed time.Duration, info *tapo.DeviceInfo, raw *rawDeviceInfo, rlog log.Logger) refreshPlan {
 	d.Lock()
 	defer d.Unlock()
+	d.setInfo(start, info, raw, rlog)
+	d.duration.Set(elapsed.Seconds())
+	return refreshPlan{
+		countdown: cfg.Countdown && !d.noCountdown,
+		energy:    d.supportsPower && time.Since(d.lastEnergyFetch) >= cfg.EnergyInterval,
+		children:  d.supportsStrip,
+	}
+}
 
-	collect(d.up, ch)
-	collect(d.errors, ch)
+// countError counts an error against the device, with the lock held as /reset
+// may swap the counter.
+func (d *Device) countError() {
+	d.Lock()
+	defer d.Unlock()
+	d.errors.Inc()
+}
 
-	if d.lastWasValid {
-		collect(d.on, ch)
-		collect(d.onTime, ch)
-		collect(d.overheated, ch)
-		collect(d.currentPower, ch)
-		collect(d.todayRuntime, ch)
-		collect(d.todayWattHours, ch)
+func (d *Device) recordClockDrift(drift time.Duration, info *tapo.DeviceInfo) {
+	d.Lock()
+	defer d.Unlock()
+	if d.clockDrift == nil {
+		d.clockDrift = d.stdGauge("clock_drift_seconds", "Device clock minus exporter clock", info)
 	}
+	d.clockDrift.Set(drift.Seconds())
 }
 
-func collect(m prometheus.Collector, ch chan<- prometheus.Metric) {
-	if m != nil {
-		m.Collect(ch)
+func (d *Device) recordCountdown(remaining float64, supported bool, err error, info *tapo.DeviceInfo, rlog log.Logger) {
+	d.Lock()
+	defer d.Unlock()
+	switch {
+	case err != nil:
+		level.Debug(rlog).Log("device", d.address, "op", "countdown", "err", err)
+	case !supported:
+		level.Debug(rlog).Log("device", d.address, "msg", "Device does not report countdown rules")
+		d.noCountdown = true
+	default:
+		if d.countdown == nil {
+			d.countdown = d.stdGauge("countdown_remaining_seconds", "Time until the countdown timer fires, or 0 if none is running", info)
+		}
+		d.countdown.Set(remaining)
 	}
 }
 
-func b2f(b bool) float64 {
-	if b {
-		return 1
+func (d *Device) recordEnergy(energy *tapo.EnergyUsage, err error, rlog log.Logger) {
+	d.Lock()
+	defer d.Unlock()
+	if err != nil {
+		level.Warn(rlog).Log("device", d.address, "op", "energy", "err", err)
+		d.energyErrors.Inc()
+		d.energyValid.Set(0)
+		return
+	}
+	d.lastEnergyFetch = time.Now()
+	d.lastEnergy = energy
+	setGauge(d.todayRuntime, float64(energy.TodayRuntimeMins))
+	setGauge(d.todayWattHours, float64(energy.TodayEnergyWattHours))
+	setGauge(d.monthRuntime, float64(energy.MonthRuntimeMins))
+	setGauge(d.monthWattHours, float64(energy.MonthEnergyWattHours))
+	setGauge(d.todayKWh, float64(energy.TodayEnergyWattHours)/1000.0)
+	setGauge(d.monthKWh, float64(energy.MonthEnergyWattHours)/1000.0)
+	setGauge(d.currentPower, roundPower(float64(energy.CurrentPowerMilliWatts)/1000.0))
+	d.energyValid.Set(1)
+	// tapo-lib does not decode a load-detection field, so derive it.
+	d.loadDetected.Set(b2f(float64(energy.CurrentPowerMilliWatts)/1000.0 > cfg.LoadThresholdWatts))
+	if d.powerHist != nil {
+		d.powerHist.Observe(float64(energy.CurrentPowerMilliWatts) / 1000.0)
 	}
-	return 0
 }
 
-func stdGauge(name string, help string, info *tapo.DeviceInfo) prometheus.Gauge {
-	devType := strings.ToLower(info.Avatar)
-	if devType == "" {
-		devType = info.Model
+func (d *Device) recordChildren(children []childDevice) {
+	d.Lock()
+	defer d.Unlock()
+	for _, child := range children {
+		g := d.outletOn.WithLabelValues(strconv.Itoa(child.Position))
+		g.Set(b2f(child.DeviceOn))
+		d.outlets[child.Position] = g
 	}
-	nick := info.Nickname
-	return prometheus.NewGauge(prometheus.GaugeOpts{
-		Namespace: namespace,
-		Subsystem: subsystem,
-		Name:      name,
-		Help:      help,
-		ConstLabels: prometheus.Labels{
-			"model": info.Model,
-			"ip":    info.IP,
-			"mac":   info.Mac,
-			"type":  devType,
-			"name":  nick,
-		},
-	})
 }
 
-type Exporter struct {
-	mutex   sync.Mutex
-	devices map[string]*Device
+// setFailed records a failed refresh, and reports whether the session is due
+// to be recreated. d must be locked.
+func (d *Device) setFailed(err error) (reconnect bool) {
+	d.lastWasValid = false
+	d.lastErr = err
+	d.up.Set(0)
+	d.errors.Inc()
+	d.lastError.Reset()
+	d.lastErrorReason = classifyError(err)
+	d.lastError.WithLabelValues(d.lastErrorReason).Set(1)
+	d.consecutiveFailures++
+	d.failures.Set(float64(d.consecutiveFailures))
+	d.backoff.Set(b2f(d.inBackoff()))
+	return cfg.ReconnectAfterFailures > 0 && d.consecutiveFailures%cfg.ReconnectAfterFailures == 0
 }
 
-func NewExporter() (*Exporter, error) {
+// setInfo records a successful refresh started at start, creating the device's
+// gauges on the first one. raw is nil if it was not needed or could not be
+// retrieved. d must be locked.
+func (d *Device) setInfo(start time.Time, info *tapo.DeviceInfo, raw *rawDeviceInfo, rlog log.Logger) {
+	if d.config.ID == "" && labelEnabled("device_id") && d.baseLabels["device_id"] != sanitizeLabelValue(info.Mac) {
+		// device_id falls back to the MAC address, which is only known once
+		// the device responds, so give the base metrics the same device_id
+		// as the rest.
+		labels := deviceBaseLabels(d.config)
+		labels["device_id"] = sanitizeLabelValue(info.Mac)
+		d.newBaseMetrics(labels)
+	}
 
-	devices := make(map[string]*Device)
-	for _, devAddress := range cfg.Devices {
-		dev, err := NewDevice(devAddress)
-		if err != nil {
-			// Should never happen in practice, even if device is offline.
-			return nil, err
+	d.lastWasValid = true
+	d.lastErr = nil
+	d.up.Set(1)
+	d.lastError.Reset()
+	d.lastErrorReason = ""
+	d.neverConnected.Set(0)
+	d.lastInfo = info
+	d.lastSeen.SetToCurrentTime()
+	d.consecutiveFailures = 0
+	d.failures.Set(0)
+	d.backoff.Set(0)
+	d.lastRefresh = start
+
+	if !d.initialised {
+		d.initialised = true
+
+		// Gauges for fields that a model omits are not created, rather than
+		// reporting the zero value tapo.DeviceInfo decodes them as. If the
+		// fields are not known, assume all are reported.
+		var reported map[string]bool
+		if raw != nil {
+			reported = raw.fields
+		}
+
+		d.on = d.stdGauge("on", "Is the plug on", info)
+		d.onTime = d.stdGauge("onTime", "Cumulative on time", info) // Cannot be a counter because Tapo may reset.
+		if cfg.OnTimeCounter {
+			d.onTimeTotal = d.stdCounter("on_time_seconds_total", "Cumulative on time, ignoring device resets", info)
+			d.prevOnTime = 0
+		}
+		d.overheated = nil
+		if reported == nil || reported["overheated"] {
+			d.overheated = d.stdGauge("overheated", "Is the plug overheated", info)
+		}
+		d.rssi = d.stdGauge("rssi", "Wi-Fi signal strength (dBm)", info)
+		d.signalLevel = nil
+		if reported == nil || reported["signal_level"] {
+			d.signalLevel = d.stdGauge("signal_level", "Wi-Fi signal strength (bars)", info)
+		}
+		infoLabels := d.infoLabels(prometheus.Labels{
+			"fw_version": sanitizeLabelValue(info.FwVer),
+			"hw_version": sanitizeLabelValue(info.HwVer),
+			"model":      sanitizeLabelValue(info.Model),
+			"mac":        sanitizeLabelValue(info.Mac),
+		})
+		if cfg.InfoLocationLabels {
+			infoLabels["region"] = sanitizeLabelValue(info.Region)
+			infoLabels["timezone"] = utcOffset(info.TimeDiff)
+		}
+		d.info = prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   cfg.MetricNamespace,
+			Subsystem:   cfg.MetricSubsystem,
+			Name:        "info",
+			Help:        "Device firmware and hardware versions",
+			ConstLabels: infoLabels,
+		})
+		d.info.Set(1)
+		d.defaultState = nil
+		d.countdown, d.noCountdown = nil, false
+		d.wifiInfo = nil
+		d.clockDrift = nil
+
+		caps := modelCapabilities[strings.ToUpper(info.Model)]
+		d.supportsPower = caps.power
+		d.canPower = d.stdGauge("supports_power", "Does the device report power usage", info)
+		d.canPower.Set(b2f(d.supportsPower))
+		if d.supportsPower {
+			d.currentPower = d.energyGauge("power", "power (watts)", info)
+			d.todayRuntime = d.energyGauge("today_runtime", "Runtime today (mins)", info)
+			d.todayWattHours = d.energyGauge("today_energy", "Energy today (watt-hours)", info)
+			d.monthRuntime = d.energyGauge("month_runtime", "Runtime this month (mins)", info)
+			d.monthWattHours = d.energyGauge("month_energy", "Energy this month (watt-hours)", info)
+			d.protection = nil
+			if reported == nil || reported["power_protection_status"] {
+				d.protection = d.stdGauge("power_protection_active", "Has power protection tripped", info)
+			}
+			d.energyErrors = d.stdCounter("energy_errors", "Count of errors retrieving energy usage", info)
+			d.energyValid = d.stdGauge("energy_valid", "Did the last energy usage request succeed", info)
+			d.loadDetected = d.stdGauge("load_detected", "Is the power drawn above LOAD_THRESHOLD_WATTS", info)
+			if cfg.PowerHistogram {
+				d.powerHist = prometheus.NewHistogram(prometheus.HistogramOpts{
+					Namespace:   cfg.MetricNamespace,
+					Subsystem:   cfg.MetricSubsystem,
+					Name:        "power_watts",
+					Help:        "Distribution of power readings (watts)",
+					ConstLabels: d.labels(info),
+					Buckets:     []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2000, 3000},
+				})
+			}
+			if cfg.EnergyKWh {
+				d.todayKWh = d.stdGauge("today_energy_kwh", "Energy today (kWh)", info)
+				d.monthKWh = d.stdGauge("month_energy_kwh", "Energy this month (kWh)", info)
+			}
+		}
+
+		d.supportsLight = caps.light
+		if d.supportsLight {
+			d.brightness = d.stdGauge("brightness", "Brightness (percent)", info)
+			d.colorTemp = d.stdGauge("color_temp", "Colour temperature (kelvin)", info)
+			d.hue = d.stdGauge("hue", "Hue (degrees)", info)
+			d.saturation = d.stdGauge("saturation", "Saturation (percent)", info)
+		}
+
+		d.supportsStrip = caps.strip
+		if d.supportsStrip {
+			d.outletOn = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Namespace:   cfg.MetricNamespace,
+				Subsystem:   cfg.MetricSubsystem,
+				Name:        "outlet_on",
+				Help:        "Is the power strip outlet on",
+				ConstLabels: d.labels(info),
+			}, []string{"outlet"})
+			d.outlets = make(map[int]prometheus.Gauge)
+		}
+	}
+
+	d.on.Set(b2f(info.DeviceOn))
+	d.onTime.Set(info.OnTime)
+	if d.onTimeTotal != nil {
+		// A decrease means the device has reset its on time, so count
+		// everything since the reset.
+		delta := info.OnTime - d.prevOnTime
+		if delta < 0 {
+			delta = info.OnTime
+		}
+		d.onTimeTotal.Add(delta)
+		d.prevOnTime = info.OnTime
+	}
+	setGauge(d.overheated, b2f(info.Overheated))
+	d.rssi.Set(float64(info.RSSI))
+	setGauge(d.signalLevel, float64(info.SignalLevel))
+	if d.wifiInfo == nil || info.SSID != d.ssid {
+		d.wifiInfo = prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: cfg.MetricNamespace,
+			Subsystem: cfg.MetricSubsystem,
+			Name:      "wifi_info",
+			Help:      "Wi-Fi network the device is connected to",
+			ConstLabels: d.infoLabels(prometheus.Labels{
+				"mac":  sanitizeLabelValue(info.Mac),
+				"ssid": sanitizeLabelValue(info.SSID),
+			}),
+		})
+		d.wifiInfo.Set(1)
+		d.ssid = info.SSID
+	}
+	if d.supportsPower {
+		// Reported as "normal" unless protection has cut the power.
+		setGauge(d.protection, b2f(info.PowerProtectionStatus != "" && info.PowerProtectionStatus != "normal"))
+	}
+
+	if state, err := defaultState(info.DefaultStates.Type, raw); err == nil {
+		if d.defaultState == nil {
+			d.defaultState = d.stdGauge("default_state", "State after power loss: 0 off, 1 on, 2 last state", info)
 		}
-		devices[devAddress] = dev
+		d.defaultState.Set(state)
+	} else {
+		level.Debug(rlog).Log("device", d.address, "op", "default_state", "err", err)
 	}
 
-	return &Exporter{
-		devices: devices,
-	}, nil
+	if d.supportsLight && raw != nil {
+		d.brightness.Set(float64(raw.Brightness))
+		d.colorTemp.Set(float64(raw.ColorTemp))
+		d.hue.Set(float64(raw.Hue))
+		d.saturation.Set(float64(raw.Saturation))
+	}
 }
 
-func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
-	e.mutex.Lock()
-	defer e.mutex.Unlock()
+// getDeviceInfo makes up to MAX_RETRIES attempts to retrieve the device info,
+// backing off exponentially (capped at the request timeout) between attempts.
+// No further attempts are made once ctx is done.
+func (d *Device) getDeviceInfo(ctx context.Context) (*tapo.DeviceInfo, error) {
+	backoff := 250 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		info, err := d.session.GetDeviceInfo()
+		if err == nil {
+			d.model, d.devType = info.Model, deviceType(info)
+		}
+		requestDuration.WithLabelValues(d.model, d.devType).Observe(time.Since(start).Seconds())
+		if err == nil || attempt >= cfg.MaxRetries {
+			return info, err
+		}
 
-	for _, dev := range e.devices {
-		dev.Describe(ch)
+		level.Debug(requestLogger(ctx)).Log("device", d.address, "attempt", attempt, "err", err, "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return info, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > cfg.RequestTimeout {
+			backoff = cfg.RequestTimeout
+		}
 	}
 }
 
-func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	e.mutex.Lock()
-	defer e.mutex.Unlock()
+// Reasons returned by classifyError.
+const (
+	reasonAuth    = "auth"
+	reasonTimeout = "timeout"
+	reasonNetwork = "network"
+	reasonOther   = "other"
+)
 
-	start := time.Now()
+// classifyError makes a best-effort guess at why a request failed. tapo-lib
+// does not export typed errors, so anything that is not a transport error but
+// carries an error code from the device is treated as an auth (or session)
+// failure.
+func classifyError(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return reasonTimeout
+		}
+		return reasonNetwork
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return reasonTimeout
+	}
 
-	wg := new(sync.WaitGroup)
-	wg.Add(len(e.devices))
-	for _, dev := range e.devices {
-		go func(dev *Device) {
-			defer wg.Done()
-			dev.refresh()
-			dev.Collect(ch)
-		}(dev)
+	msg := err.Error()
+	if strings.Contains(msg, "deviceResponse") || strings.Contains(msg, "invalid session key") {
+		return reasonAuth
 	}
-	wg.Wait()
+	return reasonOther
+}
 
-	level.Debug(logger).Log("op", "collect", "time", time.Since(start))
+// isAuthError reports whether err means the device rejected our credentials,
+// rather than being unreachable.
+func isAuthError(err error) bool {
+	return err != nil && classifyError(err) == reasonAuth
+}
+
+// deviceError is a non-zero error_code in the response to a request, which
+// tapo-lib only checks for the encrypted envelope, not for the request itself.
+type deviceError struct {
+	method string
+	code   int
+}
+
+func (e *deviceError) Error() string {
+	return fmt.Sprintf("%s: error code %d", e.method, e.code)
+}
+
+// post makes a request that tapo-lib has no wrapper for, and decodes its
+// result into result.
+func post(sess deviceSession, method string, result interface{}) error {
+	req := struct {
+		Method string `json:"method"`
+	}{Method: method}
+	resp := struct {
+		Result    json.RawMessage `json:"result"`
+		ErrorCode int             `json:"error_code"`
+	}{}
+
+	if err := sess.Post(req, &resp); err != nil {
+		return err
+	}
+	if resp.ErrorCode != 0 {
+		return &deviceError{method: method, code: resp.ErrorCode}
+	}
+	if len(resp.Result) == 0 {
+		return fmt.Errorf("%s: no result", method)
+	}
+	return json.Unmarshal(resp.Result, result)
+}
+
+// lightState holds the bulb-specific fields of get_device_info.
+type lightState struct {
+	Brightness int `json:"brightness"`
+	ColorTemp  int `json:"color_temp"`
+	Hue        int `json:"hue"`
+	Saturation int `json:"saturation"`
+}
+
+// rawDeviceInfo holds the fields of get_device_info that tapo.DeviceInfo does
+// not decode, along with the set of fields present, as tapo.DeviceInfo cannot
+// distinguish a missing field from its zero value.
+type rawDeviceInfo struct {
+	lightState
+	DefaultStates struct {
+		State struct {
+			On bool `json:"on"`
+		} `json:"state"`
+	} `json:"default_states"`
+
+	fields map[string]bool
+}
+
+func getRawDeviceInfo(sess deviceSession) (*rawDeviceInfo, error) {
+	var result json.RawMessage
+	if err := post(sess, "get_device_info", &result); err != nil {
+		return nil, err
+	}
+
+	var raw rawDeviceInfo
+	if err := json.Unmarshal(result, &raw); err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(result, &fields); err != nil {
+		return nil, err
+	}
+	raw.fields = make(map[string]bool, len(fields))
+	for name := range fields {
+		raw.fields[name] = true
+	}
+	return &raw, nil
+}
+
+// defaultState returns the value of tapo_device_default_state for the given
+// DefaultStates.Type. For "custom", whether the device comes back on is taken
+// from raw, which may be nil if it could not be retrieved.
+func defaultState(typ string, raw *rawDeviceInfo) (float64, error) {
+	switch typ {
+	case "last_states":
+		return 2, nil
+	case "custom":
+		if raw == nil {
+			return 0, errors.New("custom default state not retrieved")
+		}
+		return b2f(raw.DefaultStates.State.On), nil
+	default:
+		return 0, fmt.Errorf("unknown default state type %q", typ)
+	}
+}
+
+// getDeviceTime returns the device's clock, using get_device_time.
+func getDeviceTime(sess deviceSession) (time.Time, error) {
+	var result struct {
+		Timestamp int64 `json:"timestamp"`
+	}
+	if err := post(sess, "get_device_time", &result); err != nil {
+		return time.Time{}, err
+	}
+	if result.Timestamp == 0 {
+		return time.Time{}, errors.New("get_device_time: no timestamp")
+	}
+	return time.Unix(result.Timestamp, 0), nil
+}
+
+// getCountdown returns the time remaining on the device's enabled countdown
+// rule, if any. supported is false if the device does not understand
+// get_countdown_rules.
+func getCountdown(sess deviceSession) (remaining float64, supported bool, err error) {
+	var result struct {
+		Enable   bool `json:"enable"`
+		RuleList []struct {
+			Enable bool `json:"enable"`
+			Remain int  `json:"remain"`
+		} `json:"rule_list"`
+	}
+	if err := post(sess, "get_countdown_rules", &result); err != nil {
+		var devErr *deviceError
+		if errors.As(err, &devErr) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	if result.Enable {
+		for _, rule := range result.RuleList {
+			if rule.Enable {
+				return float64(rule.Remain), true, nil
+			}
+		}
+	}
+	return 0, true, nil
+}
+
+// childDevice holds the fields of get_child_device_list that describe a power
+// strip outlet.
+type childDevice struct {
+	Position int  `json:"position"`
+	DeviceOn bool `json:"device_on"`
+}
+
+func getChildDevices(sess deviceSession) ([]childDevice, error) {
+	var result struct {
+		ChildDeviceList []childDevice `json:"child_device_list"`
+	}
+	err := post(sess, "get_child_device_list", &result)
+	return result.ChildDeviceList, err
+}
+
+// normalizeAddress strips the brackets from an IPv6 literal, so that
+// "[2001:db8::1]" and "2001:db8::1" refer to the same device. An explicit
+// default port is dropped too.
+func normalizeAddress(address string) string {
+	if host, port := splitPort(address); port != "" {
+		if port == defaultPort {
+			return normalizeAddress(host)
+		}
+		return net.JoinHostPort(normalizeAddress(host), port)
+	}
+	if strings.HasPrefix(address, "[") && strings.HasSuffix(address, "]") {
+		address = address[1 : len(address)-1]
+	}
+	if ip := net.ParseIP(address); ip != nil {
+		return ip.String()
+	}
+	return address
+}
+
+// defaultPort is the port devices listen on, used when none is given.
+const defaultPort = "80"
+
+// splitPort splits an explicit port, as in "host:port" or "[ipv6]:port", from
+// address. A bare IPv6 address (with no brackets) is taken to have no port.
+func splitPort(address string) (host, port string) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address, ""
+	}
+	return host, port
+}
+
+// validatePort checks that address's port, if it has one, is a valid number.
+func validatePort(address string) error {
+	_, port := splitPort(address)
+	if port == "" {
+		return nil
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port %q in device address %q", port, address)
+	}
+	return nil
+}
+
+// urlHost returns address in the form needed for the host part of a URL,
+// i.e. bracketing IPv6 literals.
+func urlHost(address string) string {
+	if strings.Contains(address, ":") {
+		return "[" + address + "]"
+	}
+	return address
+}
+
+// resolve looks up the IP address for host. IP addresses are returned as-is,
+// as is host if it cannot be resolved.
+func resolve(host string) string {
+	if net.ParseIP(host) != nil {
+		return host
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		level.Warn(logger).Log("msg", "Could not resolve device address", "device", host, "err", err)
+		return host
+	}
+	return addrs[0]
+}
+
+// inBackoff reports whether the device has failed often enough to be polled
+// only every BACKOFF_INTERVALS intervals. d must be locked.
+func (d *Device) inBackoff() bool {
+	return cfg.BackoffAfterFailures > 0 && d.consecutiveFailures >= cfg.BackoffAfterFailures
+}
+
+// skipPoll reports whether the current poll should be skipped because the
+// device is backing off.
+func (d *Device) skipPoll() bool {
+	d.Lock()
+	defer d.Unlock()
+
+	if !d.inBackoff() || d.skippedPolls+1 >= cfg.BackoffIntervals {
+		d.skippedPolls = 0
+		return false
+	}
+	d.skippedPolls++
+	return true
+}
+
+// reconnect discards the current session, e.g. after the device has rebooted
+// and no longer recognises our session key. d.sessionMutex must be held.
+func (d *Device) reconnect() {
+	level.Info(logger).Log("msg", "Recreating session", "device", d.address)
+	if err := d.newSession(); err != nil {
+		level.Warn(logger).Log("msg", "Could not recreate session", "device", d.address, "err", err)
+		return
+	}
+	d.Lock()
+	d.reconnects.Inc()
+	d.Unlock()
+}
+
+// setOn switches the device on or off.
+func (d *Device) setOn(on bool) error {
+	d.sessionMutex.Lock()
+	defer d.sessionMutex.Unlock()
+
+	if err := d.session.Switch(on); err != nil {
+		return err
+	}
+	d.Lock()
+	setGauge(d.on, b2f(on))
+	d.Unlock()
+	return nil
+}
+
+func (d *Device) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range d.metrics() {
+		ch <- m
+	}
+}
+
+// metrics returns the device's current metrics. Its gauges and counters are
+// metrics themselves, so they are gathered without a channel to drain.
+func (d *Device) metrics() []prometheus.Metric {
+	d.Lock()
+	defer d.Unlock()
+
+	d.sessionAge.Set(time.Since(d.sessionStart).Seconds())
+	ms := appendMetrics(nil, d.up, d.errors, d.reconnects, d.duration, d.lastSeen, d.failures, d.sessionAge)
+	if d.lastErrorReason != "" {
+		ms = append(ms, d.lastError.WithLabelValues(d.lastErrorReason))
+	}
+	ms = appendMetrics(ms, d.neverConnected, d.backoff, d.energyErrors)
+
+	if !d.lastWasValid {
+		return ms
+	}
+	state := d.stateMetrics()
+	if cfg.MetricTimestamps {
+		// Stamp the state with the time it was read, so that stale values are
+		// visible as such.
+		for i, m := range state {
+			state[i] = prometheus.NewMetricWithTimestamp(d.lastRefresh, m)
+		}
+	}
+	return append(ms, state...)
+}
+
+// stateMetrics returns the metrics describing the device's state as of its
+// last successful refresh. d must be locked.
+func (d *Device) stateMetrics() []prometheus.Metric {
+	ms := appendMetrics(nil,
+		d.on, d.onTime, d.onTimeTotal, d.overheated, d.rssi, d.signalLevel,
+		d.info, d.wifiInfo, d.clockDrift, d.canPower, d.defaultState, d.countdown,
+		d.currentPower, d.todayRuntime, d.todayWattHours, d.monthRuntime, d.monthWattHours,
+		d.protection, d.energyValid, d.loadDetected, d.powerHist, d.todayKWh, d.monthKWh,
+		d.brightness, d.colorTemp, d.hue, d.saturation)
+	for _, g := range d.outlets {
+		ms = append(ms, g)
+	}
+	return ms
+}
+
+// appendMetrics appends those of metrics that have been created to ms.
+func appendMetrics(ms []prometheus.Metric, metrics ...prometheus.Metric) []prometheus.Metric {
+	for _, m := range metrics {
+		if m != nil {
+			ms = append(ms, m)
+		}
+	}
+	return ms
+}
+
+// setGauge sets g, if it has been created.
+func setGauge(g prometheus.Gauge, v float64) {
+	if g != nil {
+		g.Set(v)
+	}
+}
+
+// infoLabels adds the device's base labels to those of an info metric, so that
+// two devices reporting the same MAC address (e.g. cloned after a factory
+// reset) still have distinct series.
+func (d *Device) infoLabels(labels prometheus.Labels) prometheus.Labels {
+	for name, value := range d.baseLabels {
+		labels[name] = value
+	}
+	return labels
+}
+
+// roundPower rounds watts to the nearest multiple of POWER_PRECISION, if set.
+// Dividing by the reciprocal keeps e.g. 0.1W steps free of float noise.
+func roundPower(watts float64) float64 {
+	if cfg.PowerPrecision <= 0 {
+		return watts
+	}
+	scale := 1 / cfg.PowerPrecision
+	return math.Round(watts*scale) / scale
+}
+
+// utcOffset formats the device's time_diff, in minutes, as e.g. "UTC+01:00".
+func utcOffset(minutes int) string {
+	sign := '+'
+	if minutes < 0 {
+		sign, minutes = '-', -minutes
+	}
+	return fmt.Sprintf("UTC%c%02d:%02d", sign, minutes/60, minutes%60)
+}
+
+func b2f(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// deviceType returns the avatar chosen in the Tapo app, falling back to the
+// model if there is none. If TYPE_LABEL is "model" the avatar is ignored.
+func deviceType(info *tapo.DeviceInfo) string {
+	var devType string
+	if cfg.TypeLabel != "model" {
+		devType = strings.ToLower(info.Avatar)
+	}
+	if devType == "" {
+		devType = info.Model
+	}
+	return devType
+}
+
+// stdLabels are the const labels that may be attached to device gauges.
+var stdLabels = []string{"model", "ip", "mac", "type", "name", "device_id", "room"}
+
+func (d *Device) stdGauge(name string, help string, info *tapo.DeviceInfo) prometheus.Gauge {
+	return prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   cfg.MetricNamespace,
+		Subsystem:   cfg.MetricSubsystem,
+		Name:        name,
+		Help:        help,
+		ConstLabels: d.labels(info),
+	})
+}
+
+// energyGauge returns a stdGauge, or nil if ENERGY_METRICS excludes it.
+func (d *Device) energyGauge(name string, help string, info *tapo.DeviceInfo) prometheus.Gauge {
+	for _, m := range cfg.EnergyMetrics {
+		if m == name {
+			return d.stdGauge(name, help, info)
+		}
+	}
+	return nil
+}
+
+func (d *Device) stdCounter(name string, help string, info *tapo.DeviceInfo) prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   cfg.MetricNamespace,
+		Subsystem:   cfg.MetricSubsystem,
+		Name:        name,
+		Help:        help,
+		ConstLabels: d.labels(info),
+	})
+}
+
+// labels returns the LABELS-selected const labels for the device, plus any of
+// its base labels that LABELS does not select, so that every device's series
+// stay distinct whatever subset is chosen. A name given in the config takes
+// precedence over the nickname set in the Tapo app.
+func (d *Device) labels(info *tapo.DeviceInfo) prometheus.Labels {
+	devType := deviceType(info)
+	nick := info.Nickname
+	if d.name != "" {
+		nick = d.name
+	}
+	all := prometheus.Labels{
+		"model": info.Model,
+		"ip":    info.IP,
+		"mac":   info.Mac,
+		"type":  devType,
+		"name":  nick,
+		// Stable across IP changes. Not included by default.
+		"device_id": d.deviceID(info),
+		// From CONFIG_FILE; added whenever configured, whatever LABELS says.
+		"room": d.config.Room,
+	}
+
+	labels := make(prometheus.Labels, len(cfg.Labels))
+	for _, l := range cfg.Labels {
+		labels[l] = sanitizeLabelValue(all[l])
+	}
+	for name, value := range d.baseLabels {
+		if _, ok := labels[name]; !ok {
+			labels[name] = value
+		}
+	}
+	return labels
+}
+
+// deviceID returns the configured ID for the device, or its MAC address.
+func (d *Device) deviceID(info *tapo.DeviceInfo) string {
+	if d.config.ID != "" {
+		return d.config.ID
+	}
+	return info.Mac
+}
+
+// sanitizeLabelValue makes user-supplied values, such as nicknames, safe to use
+// as label values: invalid UTF-8 is dropped, control characters such as
+// newlines become spaces, and runs of whitespace are collapsed.
+func sanitizeLabelValue(s string) string {
+	s = strings.ToValidUTF8(s, "")
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, s)
+	return strings.Join(strings.Fields(s), " ")
+}
+
+type Exporter struct {
+	mutex   sync.Mutex
+	devices map[string]*Device
+	skipped []skippedDevice // Devices that could not be created.
+
+	sem          atomic.Value    // chan struct{} bounding the number of concurrent refreshes.
+	jobs         chan collectJob // Devices for the collect workers to gather.
+	ctx          context.Context
+	cancel       context.CancelFunc
+	pollers      sync.WaitGroup
+	stopPoll     map[string]context.CancelFunc // Stops each device's poller.
+	rnd          *rand.Rand                    // For poll jitter; guarded by mutex.
+	macMutex     sync.Mutex
+	macs         map[string]string // MAC address to device address, for checkMAC.
+	scrapeErrors prometheus.Counter
+	configured   prometheus.Gauge
+	up           prometheus.Gauge
+	totalPower   prometheus.Gauge
+	active       prometheus.Gauge
+	collectTime  *prometheus.Desc
+	configInfo   *prometheus.Desc
+	lastCollect  time.Duration
+}
+
+// skippedDevice is a configured device that could not be created, which is
+// reported as down by its "up" placeholder.
+type skippedDevice struct {
+	address string
+	up      prometheus.Gauge
+}
+
+// deviceConfigs loads the device list, normalizing each address and applying
+// DISABLED_DEVICES and DEVICE_POLL_INTERVALS.
+func deviceConfigs() ([]DeviceConfig, error) {
+	devConfigs, err := loadDevices()
+	if err != nil {
+		return nil, err
+	}
+	if len(devConfigs) == 0 {
+		return nil, errors.New("no devices configured: set DEVICES, CONFIG_FILE, CONFIG_DIR or DISCOVER")
+	}
+
+	disabled := make(map[string]bool)
+	for _, address := range cfg.DisabledDevices {
+		disabled[normalizeAddress(strings.TrimSpace(address))] = true
+	}
+	intervals, err := parsePollIntervals(cfg.DevicePollIntervals)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for i := range devConfigs {
+		dc := &devConfigs[i]
+		if err := validatePort(dc.Address); err != nil {
+			return nil, err
+		}
+		dc.Address = normalizeAddress(dc.Address)
+		dc.Disabled = dc.Disabled || disabled[dc.Address]
+		if dc.PollInterval == 0 {
+			dc.PollInterval = intervals[dc.Address]
+		}
+		if seen[dc.Address] {
+			return nil, fmt.Errorf("device %q is configured more than once", dc.Address)
+		}
+		seen[dc.Address] = true
+	}
+	return devConfigs, nil
+}
+
+// parsePollIntervals parses DEVICE_POLL_INTERVALS entries of the form
+// address=interval, keyed by normalized address. "=" is used because ":"
+// appears in IPv6 addresses and host:port.
+func parsePollIntervals(entries []string) (map[string]time.Duration, error) {
+	intervals := make(map[string]time.Duration)
+	for _, entry := range entries {
+		address, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid DEVICE_POLL_INTERVALS entry %q: expected address=interval", entry)
+		}
+		interval, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid poll interval %q for device %q", value, address)
+		}
+		intervals[normalizeAddress(strings.TrimSpace(address))] = interval
+	}
+	return intervals, nil
+}
+
+func NewExporter() (*Exporter, error) {
+	devConfigs, err := deviceConfigs()
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make(map[string]*Device)
+	var skipped []skippedDevice
+	for _, dc := range devConfigs {
+		dev, err := NewDevice(dc)
+		if err != nil {
+			// Report the device as down rather than refusing to start.
+			level.Error(logger).Log("msg", "Skipping device", "device", dc.Address, "err", err)
+			skipped = append(skipped, skippedDevice{address: dc.Address, up: newUpGauge(deviceBaseLabels(dc))})
+			continue
+		}
+		devices[dc.Address] = dev
+	}
+	if len(devices) == 0 {
+		return nil, errors.New("none of the configured devices could be created")
+	}
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: cfg.MetricNamespace,
+		Subsystem: cfg.MetricSubsystem,
+		Name:      "request_duration_seconds",
+		Help:      "Latency of device info requests",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"model", "type"})
+
+	e := &Exporter{
+		devices:  devices,
+		skipped:  skipped,
+		stopPoll: make(map[string]context.CancelFunc),
+		macs:     make(map[string]string),
+		rnd:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		scrapeErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "tapo_exporter",
+			Name:      "scrape_errors_total",
+			Help:      "Count of failed device refreshes, across all devices",
+		}),
+		configured: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "tapo_exporter",
+			Name:      "devices_configured",
+			Help:      "Number of configured devices",
+		}),
+		up: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "tapo_exporter",
+			Name:      "devices_up",
+			Help:      "Number of devices that were reachable on their last refresh",
+		}),
+		totalPower: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "tapo_exporter",
+			Name:      "total_power_watts",
+			Help:      "Total power drawn by all reachable energy-monitoring devices",
+		}),
+		active: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "tapo_exporter",
+			Name:      "active_refreshes",
+			Help:      "Number of device refreshes in progress",
+		}),
+		collectTime: prometheus.NewDesc(
+			"tapo_exporter_last_collect_duration_seconds",
+			"Time taken by the previous collection",
+			nil, nil),
+		// Note that version.NewCollector already owns tapo_exporter_build_info.
+		configInfo: prometheus.NewDesc(
+			"tapo_exporter_config_info",
+			"Configuration the exporter was started with",
+			[]string{"devices"},
+			prometheus.Labels{"version": version.Version, "poll_interval": cfg.PollInterval.String()}),
+	}
+	e.resizeSem()
+
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+
+	workers := cfg.CollectWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	e.jobs = make(chan collectJob)
+	for i := 0; i < workers; i++ {
+		go e.collectWorker()
+	}
+
+	return e, nil
+}
+
+// start begins polling each device in the background.
+// Each device is delayed by a random fraction (up to POLL_JITTER) of the
+// interval, so that they are not all polled at the same instant.
+func (e *Exporter) start() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for _, dev := range e.devices {
+		e.startPoller(dev)
+	}
+}
+
+// startPoller starts polling dev, unless it is disabled. e.mutex must be held.
+func (e *Exporter) startPoller(dev *Device) {
+	if dev.disabled {
+		level.Info(logger).Log("msg", "Device is disabled", "device", dev.address)
+		return
+	}
+	jitter := time.Duration(e.rnd.Float64() * cfg.PollJitter * float64(dev.pollInterval))
+	ctx, cancel := context.WithCancel(e.ctx)
+	e.stopPoll[dev.address] = cancel
+	e.pollers.Add(1)
+	go func() {
+		defer e.pollers.Done()
+		e.poll(ctx, dev, dev.pollInterval, jitter)
+	}()
+}
+
+// resizeSem sizes the refresh semaphore for the current devices, unless
+// MAX_CONCURRENT_SCRAPES is set. Refreshes in progress release the semaphore
+// they took. e.mutex must be held, or e not yet in use.
+func (e *Exporter) resizeSem() {
+	maxConcurrent := cfg.MaxConcurrentScrapes
+	if maxConcurrent <= 0 {
+		maxConcurrent = len(e.devices)
+	}
+	if sem, ok := e.sem.Load().(chan struct{}); ok && cap(sem) == maxConcurrent {
+		return
+	}
+	e.sem.Store(make(chan struct{}, maxConcurrent))
+}
+
+// stopPoller stops polling the device at address, if it is being polled.
+// e.mutex must be held.
+func (e *Exporter) stopPoller(address string) {
+	if stop, ok := e.stopPoll[address]; ok {
+		stop()
+		delete(e.stopPoll, address)
+	}
+}
+
+// onlyScheduleChanged reports whether old and new differ, if at all, only in
+// whether and how often the device is polled.
+func onlyScheduleChanged(old, new DeviceConfig) bool {
+	old.Disabled, old.PollInterval = new.Disabled, new.PollInterval
+	return reflect.DeepEqual(old, new)
+}
+
+// setSchedule applies dc's disabled and poll_interval settings. The device's
+// poller must be stopped, and e.mutex held.
+func (d *Device) setSchedule(dc DeviceConfig) {
+	d.Lock()
+	defer d.Unlock()
+	d.config.Disabled, d.config.PollInterval = dc.Disabled, dc.PollInterval
+	d.disabled = dc.Disabled
+	d.pollInterval = dc.PollInterval
+	if d.pollInterval <= 0 {
+		d.pollInterval = cfg.PollInterval
+	}
+}
+
+// reload re-reads the device list, e.g. on SIGHUP. New devices are created and
+// polled, and removed ones are stopped. A device whose disabled or
+// poll_interval setting changed is rescheduled, keeping its counters; one
+// whose other settings changed is recreated, as its labels or session would
+// change anyway.
+func (e *Exporter) reload() {
+	devConfigs, err := deviceConfigs()
+	if err != nil {
+		level.Error(logger).Log("msg", "Could not reload devices; keeping the current ones", "err", err)
+		return
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	configured := make(map[string]bool)
+	var skipped []skippedDevice
+	for _, dc := range devConfigs {
+		configured[dc.Address] = true
+		if dev, ok := e.devices[dc.Address]; ok {
+			if reflect.DeepEqual(dev.config, dc) {
+				continue
+			}
+			e.stopPoller(dc.Address)
+			if onlyScheduleChanged(dev.config, dc) {
+				level.Info(logger).Log("msg", "Rescheduling device", "device", dc.Address, "disabled", dc.Disabled, "poll_interval", dc.PollInterval)
+				dev.setSchedule(dc)
+				e.startPoller(dev)
+				continue
+			}
+			level.Info(logger).Log("msg", "Recreating device with new settings", "device", dc.Address)
+			delete(e.devices, dc.Address)
+		}
+		dev, err := NewDevice(dc)
+		if err != nil {
+			level.Error(logger).Log("msg", "Skipping device", "device", dc.Address, "err", err)
+			skipped = append(skipped, skippedDevice{address: dc.Address, up: newUpGauge(deviceBaseLabels(dc))})
+			continue
+		}
+		level.Info(logger).Log("msg", "Adding device", "device", dc.Address)
+		e.devices[dc.Address] = dev
+		e.startPoller(dev)
+	}
+	e.skipped = skipped
+
+	for address := range e.devices {
+		if configured[address] {
+			continue
+		}
+		level.Info(logger).Log("msg", "Removing device", "device", address)
+		e.stopPoller(address)
+		delete(e.devices, address)
+	}
+	e.resizeSem()
+
+	e.macMutex.Lock()
+	for mac, address := range e.macs {
+		if !configured[address] {
+			delete(e.macs, mac)
+		}
+	}
+	e.macMutex.Unlock()
+}
+
+// stop cancels any refreshes in progress and waits for polling to finish,
+// waiting at most timeout.
+func (e *Exporter) stop(timeout time.Duration) {
+	e.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		e.pollers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		level.Warn(logger).Log("msg", "Polling did not stop in time; exiting anyway", "timeout", timeout)
+	}
+}
+
+// refreshAll refreshes every device once, and waits for them to complete.
+func (e *Exporter) refreshAll() {
+	wg := new(sync.WaitGroup)
+	for _, dev := range e.devices {
+		wg.Add(1)
+		go func(dev *Device) {
+			defer wg.Done()
+			e.refreshDevice(dev)
+		}(dev)
+	}
+	wg.Wait()
+}
+
+// initialRefresh refreshes every device once, so that the first scrape is
+// not empty, waiting at most timeout. Devices that have not responded by then
+// continue in the background.
+func (e *Exporter) initialRefresh(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		e.refreshAll()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		level.Warn(logger).Log("msg", "Initial refresh timed out; starting anyway", "timeout", timeout)
+	}
+}
+
+// verifyCredentials refreshes every device once, and returns an error if every
+// enabled device rejected our credentials. Devices that are merely unreachable
+// do not cause an error.
+func (e *Exporter) verifyCredentials() error {
+	e.refreshAll()
+
+	checked := 0
+	for _, dev := range e.devices {
+		if dev.disabled {
+			continue
+		}
+		checked++
+		if !isAuthError(dev.lastErr) {
+			return nil
+		}
+	}
+	if checked == 0 {
+		return nil
+	}
+	return fmt.Errorf("credentials were rejected by all %d devices", checked)
+}
+
+// validate refreshes every device once and writes an OK/FAIL line for each to
+// w. It returns true if all devices were reachable.
+func (e *Exporter) validate(w io.Writer) bool {
+	e.refreshAll()
+
+	var addresses []string
+	for address := range e.devices {
+		addresses = append(addresses, address)
+	}
+	for _, sd := range e.skipped {
+		addresses = append(addresses, sd.address)
+	}
+	sort.Strings(addresses)
+
+	allOK := len(e.skipped) == 0
+	for _, address := range addresses {
+		dev, ok := e.devices[address]
+		if !ok {
+			// Could not be created, so was never refreshed.
+			fmt.Fprintf(w, "FAIL %s\n", address)
+		} else if dev.disabled {
+			fmt.Fprintf(w, "SKIP %s\n", address)
+		} else if dev.lastWasValid {
+			fmt.Fprintf(w, "OK   %s\t%s\t%s\n", address, dev.lastInfo.Model, dev.lastInfo.Nickname)
+		} else {
+			fmt.Fprintf(w, "FAIL %s\n", address)
+			allOK = false
+		}
+	}
+	return allOK
+}
+
+// refreshDevice refreshes a single device, subject to the concurrency limit.
+// A panic is logged and counted as an error rather than allowed to take down
+// the whole exporter.
+func (e *Exporter) refreshDevice(dev *Device) {
+	sem := e.sem.Load().(chan struct{})
+	sem <- struct{}{}
+	defer func() { <-sem }()
+	e.active.Inc()
+	defer e.active.Dec()
+
+	defer func() {
+		if r := recover(); r != nil {
+			level.Error(logger).Log("msg", "Panic refreshing device", "device", dev.address, "panic", r)
+			dev.countError()
+			e.scrapeErrors.Inc()
+		}
+	}()
+
+	dev.refresh(e.ctx)
+
+	dev.Lock()
+	failed := !dev.lastWasValid
+	var mac string
+	if dev.lastInfo != nil {
+		mac = dev.lastInfo.Mac
+	}
+	dev.Unlock()
+	if failed {
+		e.scrapeErrors.Inc()
+	} else {
+		e.checkMAC(dev.address, mac)
+	}
+}
+
+// checkMAC warns if a device reports the same MAC address as another.
+func (e *Exporter) checkMAC(address, mac string) {
+	if mac == "" {
+		return
+	}
+	e.macMutex.Lock()
+	defer e.macMutex.Unlock()
+
+	if other, ok := e.macs[mac]; ok && other != address {
+		level.Warn(logger).Log("msg", "Devices report the same MAC address", "mac", mac, "device", address, "other", other)
+		return
+	}
+	e.macs[mac] = address
+}
+
+// poll refreshes the device every interval, starting after jitter, until ctx
+// is done, i.e. the exporter is stopped or the device removed. Collect only
+// ever reports the values from the most recent refresh.
+func (e *Exporter) poll(ctx context.Context, dev *Device, interval, jitter time.Duration) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(jitter):
+	}
+	e.refreshDevice(dev)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if dev.skipPoll() {
+				continue
+			}
+			e.refreshDevice(dev)
+		}
+	}
+}
+
+// Describe sends no descriptors, making the Exporter an unchecked collector.
+// Most device metrics are only created once the device has first responded
+// (and are recreated if its address changes), so the set of descriptors is not
+// known up front. The registry still rejects duplicate or inconsistent metrics
+// when they are gathered.
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	start := time.Now()
+	slog := log.With(logger, "scrape_id", newRequestID())
+
+	ch <- e.scrapeErrors
+	ch <- prometheus.MustNewConstMetric(e.configInfo, prometheus.GaugeValue, 1, strconv.Itoa(len(e.devices)))
+	requestDuration.Collect(ch)
+	for _, sd := range e.skipped {
+		ch <- sd.up
+	}
+
+	// Gather devices on the collect workers, so that one whose lock is held
+	// cannot hold up the whole scrape beyond CollectTimeout. A device that
+	// cannot be queued in time is reported as timed out.
+	ctx := context.Background()
+	if cfg.CollectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.CollectTimeout)
+		defer cancel()
+	}
+	results := make(map[*Device]chan deviceResult, len(e.devices))
+	for _, dev := range e.devices {
+		// Buffered, so that a worker can deliver a result that is no longer
+		// wanted and move on.
+		c := make(chan deviceResult, 1)
+		results[dev] = c
+		select {
+		case e.jobs <- collectJob{dev: dev, result: c}:
+		case <-ctx.Done():
+		}
+	}
+
+	up := 0
+	totalPower := 0.0
+	for dev, c := range results {
+		var r deviceResult
+		var ok bool
+		// Take a result that is already there even if the deadline has
+		// passed; select picks at random when both cases are ready.
+		select {
+		case r = <-c:
+			ok = true
+		default:
+			select {
+			case r = <-c:
+				ok = true
+			case <-ctx.Done():
+			}
+		}
+		if !ok {
+			level.Warn(slog).Log("msg", "Timed out collecting device", "device", dev.address, "timeout", cfg.CollectTimeout)
+			ch <- prometheus.MustNewConstMetric(dev.upDesc.Load().(*prometheus.Desc), prometheus.GaugeValue, 0)
+			continue
+		}
+		for _, m := range r.metrics {
+			ch <- m
+		}
+		if r.up {
+			up++
+			totalPower += r.power
+		}
+	}
+
+	e.configured.Set(float64(len(e.devices) + len(e.skipped)))
+	e.up.Set(float64(up))
+	e.totalPower.Set(totalPower)
+	ch <- e.configured
+	ch <- e.up
+	ch <- e.totalPower
+	ch <- e.active
+	// This collection is still in progress, so report the previous one.
+	ch <- prometheus.MustNewConstMetric(e.collectTime, prometheus.GaugeValue, e.lastCollect.Seconds())
+	e.lastCollect = time.Since(start)
+
+	if cfg.ErrorOnAllDown && up == 0 {
+		// An invalid metric makes promhttp fail the whole scrape.
+		ch <- prometheus.NewInvalidMetric(e.up.Desc(), errors.New("no devices are up"))
+	}
+
+	level.Debug(slog).Log("op", "collect", "time", time.Since(start))
+}
+
+// deviceResult holds the metrics gathered from a single device by Collect.
+type deviceResult struct {
+	metrics []prometheus.Metric
+	up      bool
+	power   float64 // Current power in watts, if known.
+}
+
+// collectJob asks a collect worker to gather dev into result.
+type collectJob struct {
+	dev    *Device
+	result chan<- deviceResult
+}
+
+// collectWorker gathers the devices queued by Collect, for the lifetime of the
+// exporter.
+func (e *Exporter) collectWorker() {
+	for job := range e.jobs {
+		job.result <- e.gatherDevice(job.dev)
+	}
+}
+
+// gatherDevice collects dev's metrics into a deviceResult.
+func (e *Exporter) gatherDevice(dev *Device) deviceResult {
+	r := deviceResult{metrics: e.collectDevice(dev)}
+
+	dev.Lock()
+	defer dev.Unlock()
+	if dev.lastWasValid {
+		r.up = true
+		if dev.supportsPower && dev.lastEnergy != nil {
+			r.power = float64(dev.lastEnergy.CurrentPowerMilliWatts) / 1000.0
+		}
+	}
+	return r
+}
+
+// collectDevice collects a single device's metrics, recovering from any panic
+// so that the other devices are still reported.
+func (e *Exporter) collectDevice(dev *Device) (metrics []prometheus.Metric) {
+	defer func() {
+		if r := recover(); r != nil {
+			level.Error(logger).Log("msg", "Panic collecting device", "device", dev.address, "panic", r)
+			dev.countError()
+		}
+	}()
+
+	return dev.metrics()
+}
+
+// basicAuth rejects requests that do not carry the given credentials.
+func basicAuth(next http.Handler, username, password string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		// Evaluate both comparisons so that timing does not reveal which was wrong.
+		userOK := subtle.ConstantTimeCompare([]byte(u), []byte(username)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+		if !ok || !userOK || !passOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="tapo_exporter"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`
+<html>
+			<head><title>Tapo Exporter</title></head>
+			<body>
+			<h1>Tapo Exporter</h1>
+			<p><a href="{{.MetricsPath}}">Metrics</a></p>
+			<table border="1" cellpadding="4">
+			<tr><th>Device</th><th>Up</th><th>Model</th><th>Name</th></tr>
+			{{range .Devices}}<tr><td>{{.Address}}</td><td>{{if .Up}}yes{{else}}no{{end}}</td><td>{{.Model}}</td><td>{{.Name}}</td></tr>
+			{{end}}</table>
+			</body>
+</html>
+`))
+
+// index renders the landing page, listing each device and its current state.
+func (e *Exporter) index(w http.ResponseWriter, r *http.Request) {
+	type deviceRow struct {
+		Address string
+		Up      bool
+		Model   string
+		Name    string
+	}
+
+	data := struct {
+		MetricsPath string
+		Devices     []deviceRow
+	}{MetricsPath: cfg.MetricsPath}
+
+	e.mutex.Lock()
+	for _, dev := range e.devices {
+		dev.Lock()
+		row := deviceRow{Address: dev.address, Up: dev.lastWasValid, Name: dev.name}
+		if dev.lastInfo != nil {
+			row.Model = dev.lastInfo.Model
+			if row.Name == "" {
+				row.Name = dev.lastInfo.Nickname
+			}
+		}
+		dev.Unlock()
+		data.Devices = append(data.Devices, row)
+	}
+	e.mutex.Unlock()
+	sort.Slice(data.Devices, func(i, j int) bool { return data.Devices[i].Address < data.Devices[j].Address })
+
+	if err := indexTemplate.Execute(w, data); err != nil {
+		level.Warn(logger).Log("op", "index", "err", err)
+	}
+}
+
+// healthz reports 200 if at least one device was reachable on its last
+// refresh, and 503 otherwise.
+func (e *Exporter) healthz(w http.ResponseWriter, r *http.Request) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	type deviceStatus struct {
+		Address string `json:"address"`
+		Up      bool   `json:"up"`
+	}
+
+	status := struct {
+		Healthy bool           `json:"healthy"`
+		Devices []deviceStatus `json:"devices"`
+	}{}
+
+	for _, dev := range e.devices {
+		dev.Lock()
+		up := dev.lastWasValid
+		dev.Unlock()
+
+		status.Healthy = status.Healthy || up
+		status.Devices = append(status.Devices, deviceStatus{Address: dev.address, Up: up})
+	}
+	sort.Slice(status.Devices, func(i, j int) bool { return status.Devices[i].Address < status.Devices[j].Address })
+
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// control switches a device on or off, e.g.
+//
+//	curl -X POST -d device=192.168.1.10 -d state=on http://localhost:9782/control
+func (e *Exporter) control(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var on bool
+	switch state := r.FormValue("state"); strings.ToLower(state) {
+	case "on":
+		on = true
+	case "off":
+		on = false
+	default:
+		http.Error(w, fmt.Sprintf("invalid state %q: expected on or off", state), http.StatusBadRequest)
+		return
+	}
+
+	address := normalizeAddress(strings.TrimSpace(r.FormValue("device")))
+	e.mutex.Lock()
+	dev, ok := e.devices[address]
+	e.mutex.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown device %q", address), http.StatusNotFound)
+		return
+	}
+
+	if err := dev.setOn(on); err != nil {
+		level.Warn(logger).Log("op", "control", "device", address, "err", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	level.Info(logger).Log("op", "control", "device", address, "on", on)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Device string `json:"device"`
+		On     bool   `json:"on"`
+	}{address, on})
+}
+
+// reset replaces the errors counter of the named device with a new one,
+// starting again from zero. Without ENABLE_RESET, restarting the exporter is
+// the only way to reset it.
+func (e *Exporter) reset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	address := normalizeAddress(strings.TrimSpace(r.FormValue("device")))
+	e.mutex.Lock()
+	dev, ok := e.devices[address]
+	e.mutex.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown device %q", address), http.StatusNotFound)
+		return
+	}
+
+	dev.Lock()
+	dev.errors = newErrorsCounter(dev.baseLabels)
+	dev.Unlock()
+	level.Info(logger).Log("op", "reset", "device", address)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// refreshHandler refreshes the named device immediately, ignoring CACHE_TTL,
+// and returns its resulting state.
+func (e *Exporter) refreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	address := normalizeAddress(strings.TrimSpace(r.FormValue("device")))
+	e.mutex.Lock()
+	dev, ok := e.devices[address]
+	e.mutex.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown device %q", address), http.StatusNotFound)
+		return
+	}
+
+	dev.Lock()
+	dev.lastRefresh = time.Time{} // Defeat the cache.
+	dev.Unlock()
+	e.refreshDevice(dev)
+	level.Info(logger).Log("op", "refresh", "device", address)
+
+	dev.Lock()
+	defer dev.Unlock()
+	result := struct {
+		Device string            `json:"device"`
+		Up     bool              `json:"up"`
+		Error  string            `json:"error,omitempty"`
+		Info   *tapo.DeviceInfo  `json:"info,omitempty"`
+		Energy *tapo.EnergyUsage `json:"energy,omitempty"`
+	}{Device: address, Up: dev.lastWasValid}
+	if dev.lastErr != nil {
+		result.Error = dev.lastErr.Error()
+	}
+	if dev.lastWasValid {
+		result.Info, result.Energy = dev.lastInfo, dev.lastEnergy
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// debugDevices dumps each device's get_device_info result, and its
+// get_energy_usage result if it monitors energy, exactly as the device returns
+// them, so that it shows which fields a model populates. The requests are made
+// afresh, as refreshes only keep the decoded responses.
+func (e *Exporter) debugDevices(w http.ResponseWriter, r *http.Request) {
+	e.mutex.Lock()
+	devices := make(map[string]*Device, len(e.devices))
+	for address, dev := range e.devices {
+		devices[address] = dev
+	}
+	e.mutex.Unlock()
+
+	type deviceDump struct {
+		Info   json.RawMessage `json:"info,omitempty"`
+		Energy json.RawMessage `json:"energy,omitempty"`
+		Error  string          `json:"error,omitempty"`
+	}
+
+	var mu sync.Mutex
+	dump := make(map[string]deviceDump)
+	wg := new(sync.WaitGroup)
+	for address, dev := range devices {
+		wg.Add(1)
+		go func(address string, dev *Device) {
+			defer wg.Done()
+			var d deviceDump
+			var err error
+			if d.Info, d.Energy, err = dev.rawResponses(); err != nil {
+				d.Error = err.Error()
+			}
+			mu.Lock()
+			dump[address] = d
+			mu.Unlock()
+		}(address, dev)
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(dump)
+}
+
+// rawResponses returns the device's undecoded get_device_info result, and its
+// get_energy_usage result if it monitors energy.
+func (d *Device) rawResponses() (info, energy json.RawMessage, err error) {
+	d.sessionMutex.Lock()
+	defer d.sessionMutex.Unlock()
+
+	d.Lock()
+	disabled, supportsPower := d.disabled, d.supportsPower
+	d.Unlock()
+	if disabled {
+		return nil, nil, errors.New("device is disabled")
+	}
+
+	if err := post(d.session, "get_device_info", &info); err != nil {
+		return nil, nil, err
+	}
+	if supportsPower {
+		if err := post(d.session, "get_energy_usage", &energy); err != nil {
+			return info, nil, err
+		}
+	}
+	return info, energy, nil
 }
@@ -0,0 +1,917 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/kelseyhightower/envconfig"
+	"github.com/paulcager/tapo-lib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/expfmt"
+)
+
+// fakeSession stands in for a device, answering from canned responses.
+type fakeSession struct {
+	mu        sync.Mutex
+	info      *tapo.DeviceInfo
+	infoErr   error
+	energy    *tapo.EnergyUsage
+	energyErr error
+	results   map[string]interface{} // Results of other requests, by method.
+	requests  []string               // Methods requested, in order.
+}
+
+func (f *fakeSession) GetDeviceInfo() (*tapo.DeviceInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, "get_device_info")
+	if f.infoErr != nil {
+		return nil, f.infoErr
+	}
+	info := *f.info
+	return &info, nil
+}
+
+func (f *fakeSession) GetEnergyUsage() (*tapo.EnergyUsage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, "get_energy_usage")
+	if f.energyErr != nil || f.energy == nil {
+		return nil, f.energyErr
+	}
+	energy := *f.energy
+	return &energy, nil
+}
+
+func (f *fakeSession) Switch(on bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, "set_device_info")
+	f.info.DeviceOn = on
+	return nil
+}
+
+// Post answers get_device_info with the device info, and other methods from
+// results. Unknown methods get the error code a device returns for them.
+func (f *fakeSession) Post(body interface{}, response interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	var req struct {
+		Method string `json:"method"`
+	}
+	if err := json.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	f.requests = append(f.requests, req.Method)
+
+	resp := map[string]interface{}{"error_code": -1}
+	if result, ok := f.results[req.Method]; ok {
+		resp = map[string]interface{}{"error_code": 0, "result": result}
+	} else if req.Method == "get_device_info" {
+		if f.infoErr != nil {
+			return f.infoErr
+		}
+		resp = map[string]interface{}{"error_code": 0, "result": f.info}
+	}
+	if b, err = json.Marshal(resp); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, response)
+}
+
+// setupTest sets cfg to its defaults, overridden by env, and has openSession
+// return the fake for each device address.
+func setupTest(t testing.TB, env map[string]string, fakes map[string]*fakeSession) {
+	t.Helper()
+
+	// Ignore the real environment's devices; t.Setenv restores them.
+	for _, k := range []string{"DEVICES", "CONFIG_FILE", "CONFIG_DIR", "DISCOVER", "LABELS"} {
+		t.Setenv(k, "")
+		os.Unsetenv(k)
+	}
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	cfg = Config{}
+	if err := envconfig.Process("", &cfg); err != nil {
+		t.Fatal(err)
+	}
+	logger = log.NewNopLogger()
+
+	saved := openSession
+	t.Cleanup(func() { openSession = saved })
+	openSession = func(address, username, password string, client *http.Client) (deviceSession, error) {
+		fake, ok := fakes[address]
+		if !ok {
+			return nil, errors.New("no fake for " + address)
+		}
+		return fake, nil
+	}
+}
+
+// plugInfo returns the device info of a P100 plug.
+func plugInfo(ip, mac string) *tapo.DeviceInfo {
+	info := &tapo.DeviceInfo{
+		FwVer:       "1.5.5",
+		HwVer:       "1.0",
+		Model:       "P100",
+		Mac:         mac,
+		IP:          ip,
+		SSID:        "home",
+		RSSI:        -50,
+		SignalLevel: 3,
+		Avatar:      "plug",
+		Nickname:    "Kettle",
+		DeviceOn:    true,
+		OnTime:      120,
+	}
+	info.DefaultStates.Type = "last_states"
+	info.PowerProtectionStatus = "normal"
+	return info
+}
+
+// p115Info returns the device info of a P115 energy-monitoring plug.
+func p115Info(ip, mac string) *tapo.DeviceInfo {
+	info := plugInfo(ip, mac)
+	info.Model = "P115"
+	info.Nickname = "Heater"
+	return info
+}
+
+// p115Energy is the energy usage reported by the P115 fakes.
+var p115Energy = tapo.EnergyUsage{
+	TodayRuntimeMins:       30,
+	MonthRuntimeMins:       600,
+	TodayEnergyWattHours:   250,
+	MonthEnergyWattHours:   5000,
+	CurrentPowerMilliWatts: 1500500,
+}
+
+// newTestDevice creates an exporter for a single device at address, answered
+// by fake, and refreshes it once.
+func newTestDevice(t *testing.T, address string, fake *fakeSession, env map[string]string) (*Exporter, *Device) {
+	t.Helper()
+
+	if env == nil {
+		env = make(map[string]string)
+	}
+	env["DEVICES"] = address
+	setupTest(t, env, map[string]*fakeSession{urlHost(address): fake})
+
+	e, err := NewExporter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.refreshAll()
+	return e, e.devices[address]
+}
+
+func TestRefreshSuccess(t *testing.T) {
+	fake := &fakeSession{info: p115Info("192.0.2.1", "AA-BB-CC-DD-EE-01"), energy: &p115Energy}
+	e, dev := newTestDevice(t, "192.0.2.1", fake, nil)
+
+	if !dev.lastWasValid || dev.lastErr != nil {
+		t.Fatalf("refresh failed: %v", dev.lastErr)
+	}
+	gauges := []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"up", testutil.ToFloat64(dev.up), 1},
+		{"errors", testutil.ToFloat64(dev.errors), 0},
+		{"never_connected", testutil.ToFloat64(dev.neverConnected), 0},
+		{"consecutive_failures", testutil.ToFloat64(dev.failures), 0},
+		{"on", testutil.ToFloat64(dev.on), 1},
+		{"onTime", testutil.ToFloat64(dev.onTime), 120},
+		{"rssi", testutil.ToFloat64(dev.rssi), -50},
+		{"default_state", testutil.ToFloat64(dev.defaultState), 2},
+		{"power", testutil.ToFloat64(dev.currentPower), 1500.5},
+		{"today_energy", testutil.ToFloat64(dev.todayWattHours), 250},
+		{"month_runtime", testutil.ToFloat64(dev.monthRuntime), 600},
+		{"energy_valid", testutil.ToFloat64(dev.energyValid), 1},
+		{"energy_errors", testutil.ToFloat64(dev.energyErrors), 0},
+		{"load_detected", testutil.ToFloat64(dev.loadDetected), 1},
+		{"scrape_errors_total", testutil.ToFloat64(e.scrapeErrors), 0},
+	}
+	for _, g := range gauges {
+		if g.got != g.want {
+			t.Errorf("%s = %v, want %v", g.name, g.got, g.want)
+		}
+	}
+
+	// The raw device info is only requested to set the device up.
+	want := []string{"get_device_info", "get_device_info", "get_energy_usage"}
+	if strings.Join(fake.requests, " ") != strings.Join(want, " ") {
+		t.Errorf("requests = %v, want %v", fake.requests, want)
+	}
+}
+
+func TestRefreshDeviceInfoError(t *testing.T) {
+	fake := &fakeSession{info: p115Info("192.0.2.1", "AA-BB-CC-DD-EE-01"), infoErr: errors.New("deviceResponse: {ErrorCode:-1501}")}
+	e, dev := newTestDevice(t, "192.0.2.1", fake, nil)
+
+	if dev.lastWasValid || dev.lastErr == nil {
+		t.Fatal("refresh succeeded, want an error")
+	}
+	gauges := []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"up", testutil.ToFloat64(dev.up), 0},
+		{"errors", testutil.ToFloat64(dev.errors), 1},
+		{"never_connected", testutil.ToFloat64(dev.neverConnected), 1},
+		{"consecutive_failures", testutil.ToFloat64(dev.failures), 1},
+		{"last_error", testutil.ToFloat64(dev.lastError.WithLabelValues(reasonAuth)), 1},
+		{"scrape_errors_total", testutil.ToFloat64(e.scrapeErrors), 1},
+	}
+	for _, g := range gauges {
+		if g.got != g.want {
+			t.Errorf("%s = %v, want %v", g.name, g.got, g.want)
+		}
+	}
+
+	// Nothing else is requested, and no state is reported.
+	if len(fake.requests) != 1 {
+		t.Errorf("requests = %v, want only get_device_info", fake.requests)
+	}
+	if dev.on != nil || dev.currentPower != nil {
+		t.Error("state gauges were created for a device that never responded")
+	}
+	if got := len(dev.metrics()); got != 10 {
+		t.Errorf("got %d metrics, want the 10 base metrics", got)
+	}
+}
+
+func TestRefreshEnergyError(t *testing.T) {
+	fake := &fakeSession{info: p115Info("192.0.2.1", "AA-BB-CC-DD-EE-01"), energyErr: errors.New("timeout")}
+	e, dev := newTestDevice(t, "192.0.2.1", fake, nil)
+
+	if !dev.lastWasValid {
+		t.Fatalf("refresh failed: %v", dev.lastErr)
+	}
+	gauges := []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"up", testutil.ToFloat64(dev.up), 1},
+		{"errors", testutil.ToFloat64(dev.errors), 0},
+		{"on", testutil.ToFloat64(dev.on), 1},
+		{"power", testutil.ToFloat64(dev.currentPower), 0},
+		{"energy_valid", testutil.ToFloat64(dev.energyValid), 0},
+		{"energy_errors", testutil.ToFloat64(dev.energyErrors), 1},
+		{"scrape_errors_total", testutil.ToFloat64(e.scrapeErrors), 0},
+	}
+	for _, g := range gauges {
+		if g.got != g.want {
+			t.Errorf("%s = %v, want %v", g.name, g.got, g.want)
+		}
+	}
+	if dev.lastEnergy != nil {
+		t.Errorf("lastEnergy = %+v, want nil", dev.lastEnergy)
+	}
+
+	// The next refresh tries again.
+	fake.energyErr = nil
+	fake.energy = &p115Energy
+	e.refreshAll()
+	if got := testutil.ToFloat64(dev.energyValid); got != 1 {
+		t.Errorf("energy_valid after recovery = %v, want 1", got)
+	}
+}
+
+func TestRefreshPanicUnlocks(t *testing.T) {
+	// No energy reading and no error makes recording it panic with the device
+	// locked.
+	fake := &fakeSession{info: p115Info("192.0.2.1", "AA-BB-CC-DD-EE-01")}
+	setupTest(t, map[string]string{"DEVICES": "192.0.2.1"}, map[string]*fakeSession{"192.0.2.1": fake})
+	e, err := NewExporter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		e.refreshAll()
+		e.collectDevice(e.devices["192.0.2.1"])
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("refresh or collect is still blocked after a panic")
+	}
+
+	dev := e.devices["192.0.2.1"]
+	if got := testutil.ToFloat64(dev.errors); got != 1 {
+		t.Errorf("errors = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(e.scrapeErrors); got != 1 {
+		t.Errorf("scrape_errors_total = %v, want 1", got)
+	}
+}
+
+func TestStalledHandshake(t *testing.T) {
+	// A device that accepts the handshake request but never answers it.
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+	address := strings.TrimPrefix(srv.URL, "http://")
+
+	realSession := openSession
+	setupTest(t, map[string]string{"DEVICES": address, "REQUEST_TIMEOUT": "200ms", "REFRESH_DEADLINE": "300ms"}, nil)
+	openSession = realSession
+	saved, savedClient := deviceTransport, *http.DefaultClient
+	t.Cleanup(func() { deviceTransport, *http.DefaultClient = saved, savedClient })
+	if err := configureTransport(); err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewExporter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		e.refreshAll()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("refresh is still blocked on the handshake")
+	}
+	if e.devices[address].lastWasValid {
+		t.Error("refresh of a stalled device succeeded")
+	}
+}
+
+// deviceCollector exposes a single Device as an unchecked collector, for
+// testutil.
+type deviceCollector struct{ *Device }
+
+func (deviceCollector) Describe(chan<- *prometheus.Desc) {}
+
+// timingMetrics are the device metrics whose values depend on timing, so only
+// their presence is checked.
+var timingMetrics = []string{
+	"tapo_device_last_success_timestamp_seconds",
+	"tapo_device_scrape_duration_seconds",
+	"tapo_device_session_age_seconds",
+}
+
+func TestDeviceMetrics(t *testing.T) {
+	tests := []struct {
+		name string
+		fake *fakeSession
+		want string
+	}{
+		{
+			name: "plug",
+			fake: &fakeSession{info: plugInfo("192.0.2.1", "AA-BB-CC-DD-EE-01")},
+			want: `
+			# HELP tapo_device_backoff_active Is the device being polled less often after repeated failures
+			# TYPE tapo_device_backoff_active gauge
+			tapo_device_backoff_active{ip="192.0.2.1"} 0
+			# HELP tapo_device_consecutive_failures Number of refreshes that have failed since the last success
+			# TYPE tapo_device_consecutive_failures gauge
+			tapo_device_consecutive_failures{ip="192.0.2.1"} 0
+			# HELP tapo_device_default_state State after power loss: 0 off, 1 on, 2 last state
+			# TYPE tapo_device_default_state gauge
+			tapo_device_default_state{ip="192.0.2.1",mac="AA-BB-CC-DD-EE-01",model="P100",name="Kettle",type="plug"} 2
+			# HELP tapo_device_errors Count of errors retrieving details
+			# TYPE tapo_device_errors counter
+			tapo_device_errors{ip="192.0.2.1"} 0
+			# HELP tapo_device_info Device firmware and hardware versions
+			# TYPE tapo_device_info gauge
+			tapo_device_info{fw_version="1.5.5",hw_version="1.0",ip="192.0.2.1",mac="AA-BB-CC-DD-EE-01",model="P100"} 1
+			# HELP tapo_device_never_connected Set to 1 until the device first responds
+			# TYPE tapo_device_never_connected gauge
+			tapo_device_never_connected{ip="192.0.2.1"} 0
+			# HELP tapo_device_on Is the plug on
+			# TYPE tapo_device_on gauge
+			tapo_device_on{ip="192.0.2.1",mac="AA-BB-CC-DD-EE-01",model="P100",name="Kettle",type="plug"} 1
+			# HELP tapo_device_onTime Cumulative on time
+			# TYPE tapo_device_onTime gauge
+			tapo_device_onTime{ip="192.0.2.1",mac="AA-BB-CC-DD-EE-01",model="P100",name="Kettle",type="plug"} 120
+			# HELP tapo_device_overheated Is the plug overheated
+			# TYPE tapo_device_overheated gauge
+			tapo_device_overheated{ip="192.0.2.1",mac="AA-BB-CC-DD-EE-01",model="P100",name="Kettle",type="plug"} 0
+			# HELP tapo_device_reconnects Count of sessions recreated after repeated errors
+			# TYPE tapo_device_reconnects counter
+			tapo_device_reconnects{ip="192.0.2.1"} 0
+			# HELP tapo_device_rssi Wi-Fi signal strength (dBm)
+			# TYPE tapo_device_rssi gauge
+			tapo_device_rssi{ip="192.0.2.1",mac="AA-BB-CC-DD-EE-01",model="P100",name="Kettle",type="plug"} -50
+			# HELP tapo_device_signal_level Wi-Fi signal strength (bars)
+			# TYPE tapo_device_signal_level gauge
+			tapo_device_signal_level{ip="192.0.2.1",mac="AA-BB-CC-DD-EE-01",model="P100",name="Kettle",type="plug"} 3
+			# HELP tapo_device_supports_power Does the device report power usage
+			# TYPE tapo_device_supports_power gauge
+			tapo_device_supports_power{ip="192.0.2.1",mac="AA-BB-CC-DD-EE-01",model="P100",name="Kettle",type="plug"} 0
+			# HELP tapo_device_up Is the device up
+			# TYPE tapo_device_up gauge
+			tapo_device_up{ip="192.0.2.1"} 1
+			# HELP tapo_device_wifi_info Wi-Fi network the device is connected to
+			# TYPE tapo_device_wifi_info gauge
+			tapo_device_wifi_info{ip="192.0.2.1",mac="AA-BB-CC-DD-EE-01",ssid="home"} 1
+`,
+		},
+		{
+			name: "P115",
+			fake: &fakeSession{info: p115Info("192.0.2.2", "AA-BB-CC-DD-EE-02"), energy: &p115Energy},
+			want: `
+			# HELP tapo_device_backoff_active Is the device being polled less often after repeated failures
+			# TYPE tapo_device_backoff_active gauge
+			tapo_device_backoff_active{ip="192.0.2.2"} 0
+			# HELP tapo_device_consecutive_failures Number of refreshes that have failed since the last success
+			# TYPE tapo_device_consecutive_failures gauge
+			tapo_device_consecutive_failures{ip="192.0.2.2"} 0
+			# HELP tapo_device_default_state State after power loss: 0 off, 1 on, 2 last state
+			# TYPE tapo_device_default_state gauge
+			tapo_device_default_state{ip="192.0.2.2",mac="AA-BB-CC-DD-EE-02",model="P115",name="Heater",type="plug"} 2
+			# HELP tapo_device_energy_errors Count of errors retrieving energy usage
+			# TYPE tapo_device_energy_errors counter
+			tapo_device_energy_errors{ip="192.0.2.2",mac="AA-BB-CC-DD-EE-02",model="P115",name="Heater",type="plug"} 0
+			# HELP tapo_device_energy_valid Did the last energy usage request succeed
+			# TYPE tapo_device_energy_valid gauge
+			tapo_device_energy_valid{ip="192.0.2.2",mac="AA-BB-CC-DD-EE-02",model="P115",name="Heater",type="plug"} 1
+			# HELP tapo_device_errors Count of errors retrieving details
+			# TYPE tapo_device_errors counter
+			tapo_device_errors{ip="192.0.2.2"} 0
+			# HELP tapo_device_info Device firmware and hardware versions
+			# TYPE tapo_device_info gauge
+			tapo_device_info{fw_version="1.5.5",hw_version="1.0",ip="192.0.2.2",mac="AA-BB-CC-DD-EE-02",model="P115"} 1
+			# HELP tapo_device_load_detected Is the power drawn above LOAD_THRESHOLD_WATTS
+			# TYPE tapo_device_load_detected gauge
+			tapo_device_load_detected{ip="192.0.2.2",mac="AA-BB-CC-DD-EE-02",model="P115",name="Heater",type="plug"} 1
+			# HELP tapo_device_month_energy Energy this month (watt-hours)
+			# TYPE tapo_device_month_energy gauge
+			tapo_device_month_energy{ip="192.0.2.2",mac="AA-BB-CC-DD-EE-02",model="P115",name="Heater",type="plug"} 5000
+			# HELP tapo_device_month_runtime Runtime this month (mins)
+			# TYPE tapo_device_month_runtime gauge
+			tapo_device_month_runtime{ip="192.0.2.2",mac="AA-BB-CC-DD-EE-02",model="P115",name="Heater",type="plug"} 600
+			# HELP tapo_device_never_connected Set to 1 until the device first responds
+			# TYPE tapo_device_never_connected gauge
+			tapo_device_never_connected{ip="192.0.2.2"} 0
+			# HELP tapo_device_on Is the plug on
+			# TYPE tapo_device_on gauge
+			tapo_device_on{ip="192.0.2.2",mac="AA-BB-CC-DD-EE-02",model="P115",name="Heater",type="plug"} 1
+			# HELP tapo_device_onTime Cumulative on time
+			# TYPE tapo_device_onTime gauge
+			tapo_device_onTime{ip="192.0.2.2",mac="AA-BB-CC-DD-EE-02",model="P115",name="Heater",type="plug"} 120
+			# HELP tapo_device_overheated Is the plug overheated
+			# TYPE tapo_device_overheated gauge
+			tapo_device_overheated{ip="192.0.2.2",mac="AA-BB-CC-DD-EE-02",model="P115",name="Heater",type="plug"} 0
+			# HELP tapo_device_power power (watts)
+			# TYPE tapo_device_power gauge
+			tapo_device_power{ip="192.0.2.2",mac="AA-BB-CC-DD-EE-02",model="P115",name="Heater",type="plug"} 1500.5
+			# HELP tapo_device_power_protection_active Has power protection tripped
+			# TYPE tapo_device_power_protection_active gauge
+			tapo_device_power_protection_active{ip="192.0.2.2",mac="AA-BB-CC-DD-EE-02",model="P115",name="Heater",type="plug"} 0
+			# HELP tapo_device_reconnects Count of sessions recreated after repeated errors
+			# TYPE tapo_device_reconnects counter
+			tapo_device_reconnects{ip="192.0.2.2"} 0
+			# HELP tapo_device_rssi Wi-Fi signal strength (dBm)
+			# TYPE tapo_device_rssi gauge
+			tapo_device_rssi{ip="192.0.2.2",mac="AA-BB-CC-DD-EE-02",model="P115",name="Heater",type="plug"} -50
+			# HELP tapo_device_signal_level Wi-Fi signal strength (bars)
+			# TYPE tapo_device_signal_level gauge
+			tapo_device_signal_level{ip="192.0.2.2",mac="AA-BB-CC-DD-EE-02",model="P115",name="Heater",type="plug"} 3
+			# HELP tapo_device_supports_power Does the device report power usage
+			# TYPE tapo_device_supports_power gauge
+			tapo_device_supports_power{ip="192.0.2.2",mac="AA-BB-CC-DD-EE-02",model="P115",name="Heater",type="plug"} 1
+			# HELP tapo_device_today_energy Energy today (watt-hours)
+			# TYPE tapo_device_today_energy gauge
+			tapo_device_today_energy{ip="192.0.2.2",mac="AA-BB-CC-DD-EE-02",model="P115",name="Heater",type="plug"} 250
+			# HELP tapo_device_today_runtime Runtime today (mins)
+			# TYPE tapo_device_today_runtime gauge
+			tapo_device_today_runtime{ip="192.0.2.2",mac="AA-BB-CC-DD-EE-02",model="P115",name="Heater",type="plug"} 30
+			# HELP tapo_device_up Is the device up
+			# TYPE tapo_device_up gauge
+			tapo_device_up{ip="192.0.2.2"} 1
+			# HELP tapo_device_wifi_info Wi-Fi network the device is connected to
+			# TYPE tapo_device_wifi_info gauge
+			tapo_device_wifi_info{ip="192.0.2.2",mac="AA-BB-CC-DD-EE-02",ssid="home"} 1
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, dev := newTestDevice(t, tt.fake.info.IP, tt.fake, nil)
+			c := deviceCollector{dev}
+
+			var parser expfmt.TextParser
+			families, err := parser.TextToMetricFamilies(strings.NewReader(tt.want))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for name := range families {
+				names = append(names, name)
+			}
+
+			// No family may be added or removed unnoticed...
+			reg := prometheus.NewRegistry()
+			reg.MustRegister(c)
+			mfs, err := reg.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, mf := range mfs {
+				got = append(got, mf.GetName())
+			}
+			want := append(append([]string(nil), names...), timingMetrics...)
+			sort.Strings(want)
+			if strings.Join(got, " ") != strings.Join(want, " ") {
+				t.Errorf("families = %v, want %v", got, want)
+			}
+
+			// ...and the others must match exactly, labels included.
+			if err := testutil.CollectAndCompare(c, strings.NewReader(tt.want), names...); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestDeviceConfigsIPv6(t *testing.T) {
+	setupTest(t, map[string]string{
+		"USERNAME":         "user",
+		"PASSWORD":         "pass",
+		"DEVICES":          "[2001:db8::1]|alice|secret, 2001:db8::2, [2001:db8::3]:8080, [2001:db8::4]:80",
+		"DISABLED_DEVICES": "[2001:db8::2]",
+	}, nil)
+
+	devConfigs, err := deviceConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []DeviceConfig{
+		{Address: "2001:db8::1", Username: "alice", Password: "secret"},
+		{Address: "2001:db8::2", Username: "user", Password: "pass", Disabled: true},
+		{Address: "[2001:db8::3]:8080", Username: "user", Password: "pass"},
+		{Address: "2001:db8::4", Username: "user", Password: "pass"},
+	}
+	if len(devConfigs) != len(want) {
+		t.Fatalf("got %d devices, want %d: %+v", len(devConfigs), len(want), devConfigs)
+	}
+	for i := range want {
+		if !reflect.DeepEqual(devConfigs[i], want[i]) {
+			t.Errorf("device %d: got %+v, want %+v", i, devConfigs[i], want[i])
+		}
+	}
+}
+
+func TestDeviceConfigsIPv6Duplicate(t *testing.T) {
+	setupTest(t, map[string]string{"DEVICES": "2001:db8::1, [2001:db8::1]"}, nil)
+
+	if _, err := deviceConfigs(); err == nil {
+		t.Error("expected an error for a device configured twice")
+	}
+}
+
+func TestReloadChangedSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.yaml")
+	writeConfig := func(config string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(`
+devices:
+  - address: 192.0.2.1
+  - address: 192.0.2.2
+    name: Kettle
+`)
+	fakes := make(map[string]*fakeSession)
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		fakes[ip] = &fakeSession{info: plugInfo(ip, "AA-BB-CC-DD-EE-0"+ip[len(ip)-1:])}
+	}
+	setupTest(t, map[string]string{"CONFIG_FILE": path, "USERNAME": "u", "PASSWORD": "p", "POLL_JITTER": "0"}, fakes)
+	e, err := NewExporter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.start()
+	t.Cleanup(func() { e.stop(time.Second) })
+
+	checkDevices := func(n int) {
+		t.Helper()
+		if got := cap(e.sem.Load().(chan struct{})); got != n {
+			t.Errorf("refresh semaphore size = %d, want %d", got, n)
+		}
+		want := fmt.Sprintf(`
+# HELP tapo_exporter_config_info Configuration the exporter was started with
+# TYPE tapo_exporter_config_info gauge
+tapo_exporter_config_info{devices="%d",poll_interval="15s",version=""} 1
+`, n)
+		if err := testutil.CollectAndCompare(e, strings.NewReader(want), "tapo_exporter_config_info"); err != nil {
+			t.Error(err)
+		}
+	}
+	checkDevices(2)
+	first, second := e.devices["192.0.2.1"], e.devices["192.0.2.2"]
+
+	// Disabling a device stops its poller but keeps its counters.
+	writeConfig(`
+devices:
+  - address: 192.0.2.1
+    disabled: true
+  - address: 192.0.2.2
+    name: Kitchen
+  - address: 192.0.2.3
+`)
+	e.reload()
+	if e.devices["192.0.2.1"] != first || !first.disabled {
+		t.Error("192.0.2.1 was not disabled in place")
+	}
+	if _, ok := e.stopPoll["192.0.2.1"]; ok {
+		t.Error("192.0.2.1 is still polled after being disabled")
+	}
+	if dev := e.devices["192.0.2.2"]; dev == second || dev.name != "Kitchen" {
+		t.Error("192.0.2.2 was not recreated with its new name")
+	}
+	checkDevices(3)
+
+	writeConfig(`
+devices:
+  - address: 192.0.2.1
+    poll_interval: 1m
+  - address: 192.0.2.2
+    name: Kitchen
+  - address: 192.0.2.3
+`)
+	e.reload()
+	if e.devices["192.0.2.1"] != first || first.disabled || first.pollInterval != time.Minute {
+		t.Error("192.0.2.1 was not re-enabled with its new poll interval")
+	}
+	if _, ok := e.stopPoll["192.0.2.1"]; !ok {
+		t.Error("192.0.2.1 is not polled after being re-enabled")
+	}
+}
+
+func TestDeviceLabels(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "plug.yaml"), []byte(`
+address: 192.0.2.1
+labels:
+  floor: ground
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeSession{info: plugInfo("192.0.2.1", "AA-BB-CC-DD-EE-01")}
+	setupTest(t, map[string]string{"CONFIG_DIR": dir, "USERNAME": "u", "PASSWORD": "p"}, map[string]*fakeSession{"192.0.2.1": fake})
+	e, err := NewExporter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := e.devices["192.0.2.1"]
+	if got := dev.up.Desc().String(); !strings.Contains(got, `floor="ground"`) {
+		t.Errorf("up before the first refresh has no floor label: %s", got)
+	}
+	e.refreshAll()
+	if got := dev.on.Desc().String(); !strings.Contains(got, `floor="ground"`) {
+		t.Errorf("on has no floor label: %s", got)
+	}
+
+	for _, name := range []string{"mac", "room", "outlet", "__name__", "bad-name"} {
+		dc := DeviceConfig{Address: "192.0.2.1", Labels: map[string]string{name: "x"}}
+		if err := completeDeviceConfig(&dc); err == nil {
+			t.Errorf("label %q was accepted", name)
+		}
+	}
+}
+
+func TestHandlerLookupWithBrackets(t *testing.T) {
+	fake := &fakeSession{info: plugInfo("2001:db8::1", "AA-BB-CC-DD-EE-01")}
+	setupTest(t, map[string]string{
+		"DEVICES":        "2001:db8::1",
+		"ENABLE_CONTROL": "true",
+		"ENABLE_RESET":   "true",
+		"ENABLE_REFRESH": "true",
+	}, map[string]*fakeSession{"[2001:db8::1]": fake})
+
+	e, err := NewExporter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handlers := []struct {
+		name    string
+		handler http.HandlerFunc
+		form    url.Values
+		status  int
+	}{
+		{"control", e.control, url.Values{"state": {"off"}}, http.StatusOK},
+		{"reset", e.reset, url.Values{}, http.StatusNoContent},
+		{"refresh", e.refreshHandler, url.Values{}, http.StatusOK},
+	}
+	devices := []struct {
+		device string
+		found  bool
+	}{
+		{"2001:db8::1", true},
+		{"[2001:db8::1]", true},
+		{"[2001:db8::1]:80", true},
+		{" [2001:db8::1] ", true},
+		{"2001:db8:0:0:0:0:0:1", true},
+		{"2001:db8::2", false},
+		{"[2001:db8::1]:8080", false},
+	}
+
+	for _, h := range handlers {
+		for _, d := range devices {
+			form := url.Values{"device": {d.device}}
+			for k, v := range h.form {
+				form[k] = v
+			}
+			req := httptest.NewRequest(http.MethodPost, "/"+h.name, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			h.handler(rec, req)
+
+			want := h.status
+			if !d.found {
+				want = http.StatusNotFound
+			}
+			if rec.Code != want {
+				t.Errorf("%s %q: got status %d, want %d: %s", h.name, d.device, rec.Code, want, rec.Body)
+			}
+		}
+	}
+
+	if fake.info.DeviceOn {
+		t.Error("control did not switch the device off")
+	}
+}
+
+func TestDebugDevicesRaw(t *testing.T) {
+	fake := &fakeSession{info: p115Info("192.0.2.1", "AA-BB-CC-DD-EE-01"), energy: &p115Energy}
+	e, _ := newTestDevice(t, "192.0.2.1", fake, nil)
+
+	fake.results = map[string]interface{}{
+		"get_device_info": map[string]interface{}{
+			"model":         "P115",
+			"nickname":      "S2l0Y2hlbg==",
+			"overheat_mode": "normal_mode",
+		},
+		"get_energy_usage": map[string]interface{}{"current_power": 1500500},
+	}
+	w := httptest.NewRecorder()
+	e.debugDevices(w, httptest.NewRequest("GET", "/debug/devices", nil))
+
+	var dump map[string]struct {
+		Info   map[string]interface{} `json:"info"`
+		Energy map[string]interface{} `json:"energy"`
+		Error  string                 `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &dump); err != nil {
+		t.Fatal(err)
+	}
+	d := dump["192.0.2.1"]
+	if d.Error != "" {
+		t.Fatal(d.Error)
+	}
+	// The nickname is not decoded, fields tapo-lib does not know are kept and
+	// those the device omits are not added.
+	want := map[string]interface{}{"model": "P115", "nickname": "S2l0Y2hlbg==", "overheat_mode": "normal_mode"}
+	if fmt.Sprint(d.Info) != fmt.Sprint(want) {
+		t.Errorf("info = %v, want %v", d.Info, want)
+	}
+	if d.Energy["current_power"] != 1500500.0 {
+		t.Errorf("energy = %v, want current_power 1500500", d.Energy)
+	}
+}
+
+func TestAddressPorts(t *testing.T) {
+	tests := []struct {
+		address    string
+		host, port string
+		valid      bool
+		normalized string
+	}{
+		{"192.0.2.1", "192.0.2.1", "", true, "192.0.2.1"},
+		{"192.0.2.1:8080", "192.0.2.1", "8080", true, "192.0.2.1:8080"},
+		{"192.0.2.1:80", "192.0.2.1", "80", true, "192.0.2.1"},
+		{"plug.local:80", "plug.local", "80", true, "plug.local"},
+		{"plug.local:8443", "plug.local", "8443", true, "plug.local:8443"},
+		{"2001:db8::1", "2001:db8::1", "", true, "2001:db8::1"},
+		{"[2001:db8::1]", "[2001:db8::1]", "", true, "2001:db8::1"},
+		{"[2001:db8::1]:8080", "2001:db8::1", "8080", true, "[2001:db8::1]:8080"},
+		{"[2001:db8::1]:80", "2001:db8::1", "80", true, "2001:db8::1"},
+		{"[2001:DB8:0::1]:80", "2001:DB8:0::1", "80", true, "2001:db8::1"},
+		{"192.0.2.1:0", "192.0.2.1", "0", false, ""},
+		{"192.0.2.1:65536", "192.0.2.1", "65536", false, ""},
+		{"192.0.2.1:http", "192.0.2.1", "http", false, ""},
+		{"[2001:db8::1]:-1", "2001:db8::1", "-1", false, ""},
+	}
+
+	for _, tt := range tests {
+		host, port := splitPort(tt.address)
+		if host != tt.host || port != tt.port {
+			t.Errorf("splitPort(%q) = %q, %q; want %q, %q", tt.address, host, port, tt.host, tt.port)
+		}
+		err := validatePort(tt.address)
+		if (err == nil) != tt.valid {
+			t.Errorf("validatePort(%q) = %v; want valid %v", tt.address, err, tt.valid)
+		}
+		if tt.valid {
+			if got := normalizeAddress(tt.address); got != tt.normalized {
+				t.Errorf("normalizeAddress(%q) = %q; want %q", tt.address, got, tt.normalized)
+			}
+		}
+	}
+}
+
+// BenchmarkDeviceTransport polls more devices than net/http keeps idle
+// connections for, reporting how many new connections each round needs.
+func BenchmarkDeviceTransport(b *testing.B) {
+	const devices = 150
+
+	var dials int64
+	urls := make([]string, devices)
+	for i := range urls {
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, `{"error_code":0}`)
+		}))
+		srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				atomic.AddInt64(&dials, 1)
+			}
+		}
+		srv.Start()
+		b.Cleanup(srv.Close)
+		urls[i] = srv.URL
+	}
+
+	setupTest(b, nil, nil)
+	saved, savedDefault := deviceTransport, http.DefaultClient.Transport
+	b.Cleanup(func() { deviceTransport, http.DefaultClient.Transport = saved, savedDefault })
+	if err := configureTransport(); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bm := range []struct {
+		name      string
+		transport http.RoundTripper
+	}{
+		{"default", http.DefaultTransport.(*http.Transport).Clone()},
+		{"configured", deviceTransport},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			client := &http.Client{Transport: bm.transport}
+			poll := func() {
+				for _, u := range urls {
+					resp, err := client.Post(u, "application/json", strings.NewReader(`{"method":"get_device_info"}`))
+					if err != nil {
+						b.Fatal(err)
+					}
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+			}
+			poll()
+			atomic.StoreInt64(&dials, 0)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				poll()
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(atomic.LoadInt64(&dials))/float64(b.N), "conns/op")
+			client.CloseIdleConnections()
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/go-kit/log"
+)
+
+type requestIDKey struct{}
+
+// newRequestID returns a random ID for correlating the log lines of a single
+// refresh or scrape with events elsewhere, e.g. access point logs.
+func newRequestID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// withRequestID returns a copy of ctx carrying a new request ID.
+func withRequestID(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, newRequestID())
+}
+
+// requestLogger returns logger, annotated with ctx's request ID if it has one.
+func requestLogger(ctx context.Context) log.Logger {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		return log.With(logger, "request_id", id)
+	}
+	return logger
+}